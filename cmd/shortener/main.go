@@ -1,37 +1,157 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"github.com/ffrxp/go-practicum/internal/app"
 	"github.com/ffrxp/go-practicum/internal/common"
 	"github.com/ffrxp/go-practicum/internal/handlers"
 	"github.com/ffrxp/go-practicum/internal/storage"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// domainPolicyCheckInterval is the period of checking file of domain policy for changes
+const domainPolicyCheckInterval = 5 * time.Second
+
+// shutdownTimeout limits time of finishing in-flight requests and draining of background workers
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	config := common.InitConfig()
+	config, err := common.ParseConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Can't load config. Error:%s", err.Error())
+	}
+	// Migrations need only database, so settings of server are not validated for them
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(config, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed. Error:%s", err.Error())
+		}
+		return
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Can't load config. Error:%s", err.Error())
+	}
+	urlPolicy := app.DefaultURLPolicy()
+	urlPolicy.DefaultScheme = config.URLDefaultScheme
+	urlPolicy.StripFragment = config.URLStripFragment
+	urlPolicy.StripDefaultPort = config.URLStripDefaultPort
+	urlPolicy.MaxLength = config.URLMaxLength
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var domainPolicy *app.DomainPolicy
+	if config.DomainPolicyPath != "" {
+		domainPolicy, err = app.NewDomainPolicy(config.DomainPolicyPath)
+		if err != nil {
+			log.Fatalf("Can't load domain policy. Error:%s", err.Error())
+		}
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go domainPolicy.Watch(ctx, domainPolicyCheckInterval, reload)
+	}
+
+	appStorage, err := newStorage(config)
+	if err != nil {
+		log.Fatalf("Can't open storage. Error:%s", err.Error())
+	}
+	generator, err := app.NewShortCodeGenerator(config.ShortCodeGenerator, config.ShortCodeSalt, appStorage)
+	if err != nil {
+		log.Fatalf("Can't create short URL generator. Error:%s", err.Error())
+	}
+	clicks := app.NewClickRecorder(appStorage, 0)
+	sa := app.ShortenerApp{Storage: appStorage,
+		BaseAddress:  config.BaseAddress,
+		DatabasePath: config.DatabasePath,
+		Generator:    generator,
+		URLPolicy:    urlPolicy,
+		DomainPolicy: domainPolicy,
+		Clicks:       clicks}
+	h, err := handlers.NewShortenerHandler(&sa, config)
+	if err != nil {
+		log.Fatalf("Can't create handler. Error:%s", err.Error())
+	}
+	srv := &http.Server{Addr: config.ServerAddress, Handler: h}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(srv, config)
+	}()
+	// failed is set if server stopped by itself, so process exits with error after cleanup
+	failed := false
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Server stopped. Error:%s", err.Error())
+			failed = true
+		}
+	case <-ctx.Done():
+		log.Printf("Shutting down server")
+	}
+
+	// Resources are closed in order of dependency: server stops accepting requests and finishes in-flight ones,
+	// then workers store pending data, and only after that storage is closed
+	shutdownCtx, cancelFunc := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelFunc()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Cannot shut down server gracefully. Error:%s", err.Error())
+	}
+	if err := h.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Cannot stop background workers. Error:%s", err.Error())
+	}
+	clicks.Close()
+	if err := appStorage.Close(); err != nil {
+		log.Printf("Cannot close storage. Error:%s", err.Error())
+	}
+	if failed {
+		// Deferred functions are not run by os.Exit
+		cancelFunc()
+		stop()
+		os.Exit(1)
+	}
+}
+
+// listenAndServe serves HTTP or HTTPS depending on config. If HTTPS is enabled without certificate files,
+// self-signed certificate is generated
+func listenAndServe(srv *http.Server, config *common.Config) error {
+	if !config.EnableHTTPS {
+		return srv.ListenAndServe()
+	}
+	if config.TLSCertPath != "" {
+		return srv.ListenAndServeTLS(config.TLSCertPath, config.TLSKeyPath)
+	}
+	baseURL, err := url.Parse(config.BaseAddress)
+	if err != nil {
+		return err
+	}
+	log.Printf("Generating self-signed certificate. Host:%s", baseURL.Hostname())
+	cert, err := common.GenerateSelfSignedCert(baseURL.Hostname())
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// newStorage connects to database if it is set. If database is not set or unavailable,
+// storage in memory or in file is used. Error is returned if storage file can't be loaded
+func newStorage(config *common.Config) (storage.Repository, error) {
 	if config.DatabasePath != "" {
-		appStorage, err := storage.NewDatabaseStorage(config.DatabasePath)
+		ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancelFunc()
+		dbStorage, err := storage.NewDatabaseStorage(ctx, config.DatabasePath, config.DatabaseQueryTimeout)
 		if err == nil {
-			defer appStorage.Close()
-			sa := app.ShortenerApp{Storage: appStorage,
-				BaseAddress:  config.BaseAddress,
-				DatabasePath: config.DatabasePath}
-			log.Fatal(http.ListenAndServe(config.ServerAddress, handlers.NewShortenerHandler(&sa)))
+			return dbStorage, nil
 		}
 		log.Printf("Can't connect to database or init tables. Error:%s", err.Error())
-		dataStorage := storage.NewDataStorage(config.StoragePath)
-		defer dataStorage.Close()
-		sa := app.ShortenerApp{Storage: dataStorage,
-			BaseAddress:  config.BaseAddress,
-			DatabasePath: config.DatabasePath}
-		log.Fatal(http.ListenAndServe(config.ServerAddress, handlers.NewShortenerHandler(&sa)))
-	}
-	dataStorage := storage.NewDataStorage(config.StoragePath)
-	defer dataStorage.Close()
-	sa := app.ShortenerApp{Storage: dataStorage,
-		BaseAddress:  config.BaseAddress,
-		DatabasePath: config.DatabasePath}
-	log.Fatal(http.ListenAndServe(config.ServerAddress, handlers.NewShortenerHandler(&sa)))
+	}
+	return storage.OpenDataStorage(config.StoragePath)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/common"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"strconv"
+)
+
+var errMigrateUsage = errors.New("usage: shortener [flags] migrate up|down [steps]|status")
+
+// runMigrate processes "migrate" subcommand. Database is taken from -d flag or DATABASE_DSN.
+// Only database settings are validated, because migrations don't start server
+func runMigrate(config *common.Config, args []string) error {
+	if config.DatabasePath == "" {
+		return errors.New("database is not set")
+	}
+	// Error of parsing is not returned, because it may contain password from DSN
+	if _, err := pgxpool.ParseConfig(config.DatabasePath); err != nil {
+		return errors.New("database DSN can't be parsed")
+	}
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return storage.MigrateUp(ctx, config.DatabasePath)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return errMigrateUsage
+			}
+		}
+		return storage.MigrateDown(ctx, config.DatabasePath, steps)
+	case "status":
+		status, err := storage.GetMigrationStatus(ctx, config.DatabasePath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Current version: %d\nLatest version: %d\n", status.Current, status.Latest)
+		return nil
+	}
+	return errMigrateUsage
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Limits of credentials. bcrypt uses only first 72 bytes of password, so longer passwords are rejected
+const (
+	minLoginLength    = 3
+	maxLoginLength    = 64
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+var ErrInvalidCredentials = errors.New("app: invalid credentials")
+var ErrLoginTaken = errors.New("app: login is already taken")
+var ErrWrongCredentials = errors.New("app: wrong login or password")
+
+// dummyPasswordHash is compared with password of unknown login, so response time doesn't show whether login exists
+var dummyPasswordHash = []byte("$2a$10$NlLuNewMXbdBtSZtdkOGBuQsBU8rviJ3gd9bt8Bp6PYaeKz/jvq5u")
+
+// Register makes account with login and password. If anonymous user is identified by cookie, this user becomes
+// the account and history is kept. Otherwise new user is created. currentUserID is zero if user is unknown
+func (sa *ShortenerApp) Register(ctx context.Context, currentUserID int64, login string, password string) (int64, error) {
+	login = normalizeLogin(login)
+	if err := validateCredentials(login, password); err != nil {
+		return 0, err
+	}
+	if _, err := sa.Storage.GetUserByLogin(ctx, login); err == nil {
+		return 0, ErrLoginTaken
+	} else if !errors.Is(err, storage.ErrEmptyResult) {
+		return 0, err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := sa.anonymousUser(ctx, currentUserID)
+	if err != nil {
+		return 0, err
+	}
+	if userID != 0 {
+		err = sa.setCredentials(ctx, userID, login, passwordHash)
+		if err == nil {
+			return userID, nil
+		}
+		// Anonymous user may become account in concurrent request, then new user is created
+		if !errors.Is(err, storage.ErrEmptyResult) {
+			return 0, err
+		}
+	}
+	userID, err = sa.CreateUser(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := sa.setCredentials(ctx, userID, login, passwordHash); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// setCredentials sets login and password of user, who has no login yet
+func (sa *ShortenerApp) setCredentials(ctx context.Context, userID int64, login string, passwordHash []byte) error {
+	err := sa.Storage.SetUserCredentials(ctx, userID, login, string(passwordHash))
+	if errors.Is(err, storage.ErrAlreadyExist) {
+		return ErrLoginTaken
+	}
+	return err
+}
+
+// Login checks login and password and returns ID of account. If anonymous user is identified by cookie,
+// history of this user is merged into history of account. currentUserID is zero if user is unknown
+func (sa *ShortenerApp) Login(ctx context.Context, currentUserID int64, login string, password string) (int64, error) {
+	user, err := sa.Storage.GetUserByLogin(ctx, normalizeLogin(login))
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+			return 0, ErrWrongCredentials
+		}
+		return 0, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return 0, ErrWrongCredentials
+	}
+
+	anonymousID, err := sa.anonymousUser(ctx, currentUserID)
+	if err != nil {
+		return 0, err
+	}
+	if anonymousID != 0 && anonymousID != user.ID {
+		if err := sa.Storage.MergeUserHistory(ctx, anonymousID, user.ID); err != nil {
+			return 0, err
+		}
+	}
+	return user.ID, nil
+}
+
+// anonymousUser returns userID if it is registered user without login, and zero otherwise
+func (sa *ShortenerApp) anonymousUser(ctx context.Context, userID int64) (int64, error) {
+	if userID == 0 {
+		return 0, nil
+	}
+	user, err := sa.Storage.GetUser(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if user.Login != "" {
+		return 0, nil
+	}
+	return userID, nil
+}
+
+func normalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// validateCredentials checks length of login and password and symbols of login.
+// Login may contain latin letters, digits and symbols ".", "_", "-", "@"
+func validateCredentials(login string, password string) error {
+	if len(login) < minLoginLength || len(login) > maxLoginLength {
+		return fmt.Errorf("%w: login must be from %d to %d symbols", ErrInvalidCredentials, minLoginLength, maxLoginLength)
+	}
+	for _, r := range login {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && !strings.ContainsRune("._-@", r) {
+			return fmt.Errorf("%w: login contains invalid symbol %q", ErrInvalidCredentials, r)
+		}
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("%w: password must be from %d to %d bytes", ErrInvalidCredentials, minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const maxAliasLength = 64
+
+// reservedAliases can't be used as aliases because they clash with routes of service
+var reservedAliases = map[string]bool{
+	"ping": true,
+	"api":  true,
+}
+
+var ErrInvalidAlias = errors.New("app: invalid alias")
+var ErrAliasTaken = errors.New("app: alias is already taken")
+
+// ErrAliasURLExists is returned when alias is requested for URL, which already has short URL.
+// Alias is not created in this case
+var ErrAliasURLExists = errors.New("app: URL already has short URL")
+
+// AliasError describes why alias was rejected
+type AliasError struct {
+	Reason string
+}
+
+func (e *AliasError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidAlias.Error(), e.Reason)
+}
+
+func (e *AliasError) Unwrap() error {
+	return ErrInvalidAlias
+}
+
+// ValidateAlias checks that alias can be used as short URL.
+// Alias may contain latin letters, digits, "-" and "_"
+func ValidateAlias(alias string) error {
+	if alias == "" || len(alias) > maxAliasLength {
+		return &AliasError{fmt.Sprintf("length must be from 1 to %d symbols", maxAliasLength)}
+	}
+	for _, r := range alias {
+		if !isAliasSymbol(r) {
+			return &AliasError{fmt.Sprintf("symbol %q is not allowed", r)}
+		}
+	}
+	if reservedAliases[strings.ToLower(alias)] {
+		return &AliasError{fmt.Sprintf("%s is reserved", alias)}
+	}
+	return nil
+}
+
+func isAliasSymbol(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_'
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"time"
+)
+
+// apiKeyLength and apiKeyIDLength are the numbers of random bytes of key and of its public identifier
+const (
+	apiKeyLength   = 32
+	apiKeyIDLength = 8
+)
+
+var ErrInvalidAPIKey = errors.New("app: invalid API key")
+var ErrCantFindAPIKey = errors.New("app: cannot find API key")
+var ErrInvalidUserID = errors.New("app: invalid user ID")
+
+// IssuedAPIKey is the result of issue of API key. Key is known only at this moment, storage keeps its hash
+type IssuedAPIKey struct {
+	ID     string
+	Key    string
+	UserID int64
+}
+
+// IssueAPIKey makes new API key, which authenticates requests on behalf of user
+func (sa *ShortenerApp) IssueAPIKey(ctx context.Context, userID int64) (*IssuedAPIKey, error) {
+	if userID <= 0 {
+		return nil, fmt.Errorf("%w: user ID must be positive", ErrInvalidUserID)
+	}
+	exists, err := sa.userExists(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrCantFindUser
+	}
+	key, err := randomString(apiKeyLength, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomString(apiKeyIDLength, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	err = sa.Storage.AddAPIKey(ctx, storage.APIKey{
+		ID:        id,
+		KeyHash:   hashAPIKey(key),
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedAPIKey{ID: id, Key: key, UserID: userID}, nil
+}
+
+// RevokeAPIKey revokes API key by its identifier. Revoked key can't be used again
+func (sa *ShortenerApp) RevokeAPIKey(ctx context.Context, id string) error {
+	err := sa.Storage.RevokeAPIKey(ctx, id, time.Now())
+	if errors.Is(err, storage.ErrEmptyResult) {
+		return ErrCantFindAPIKey
+	}
+	return err
+}
+
+// AuthenticateAPIKey returns ID of user, to whom key was issued. ErrInvalidAPIKey is returned
+// for unknown and revoked keys
+func (sa *ShortenerApp) AuthenticateAPIKey(ctx context.Context, key string) (int64, error) {
+	if key == "" {
+		return 0, ErrInvalidAPIKey
+	}
+	apiKey, err := sa.Storage.GetAPIKeyByHash(ctx, hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return 0, ErrInvalidAPIKey
+		}
+		return 0, err
+	}
+	if !apiKey.RevokedAt.IsZero() {
+		return 0, fmt.Errorf("%w: key is revoked", ErrInvalidAPIKey)
+	}
+	return apiKey.UserID, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(length int, encode func([]byte) string) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
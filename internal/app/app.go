@@ -1,52 +1,170 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ffrxp/go-practicum/internal/storage"
-	"hash/crc32"
+	"log"
+	"time"
 )
 
 type ShortenerApp struct {
 	Storage      storage.Repository
 	BaseAddress  string
 	DatabasePath string
+	Generator    ShortCodeGenerator
+	URLPolicy    *URLPolicy
+	// DomainPolicy restricts destination domains. If it is nil, all domains are permitted
+	DomainPolicy *DomainPolicy
+	// Clicks records redirects. If it is nil, clicks are not recorded
+	Clicks *ClickRecorder
 }
 
+// maxGenerateAttempts limits retries of short code generation after collisions
+const maxGenerateAttempts = 10
+
 var ErrURLDeleted = errors.New("app: URL deleted")
 var ErrCantFindURL = errors.New("app: cannot find URL")
+var ErrCantGenerateShortURL = errors.New("app: cannot generate unique short URL")
+var ErrURLExpired = errors.New("app: URL expired")
+var ErrInvalidExpiration = errors.New("app: invalid expiration")
+var ErrInvalidURL = errors.New("app: invalid URL")
 
-// CreateShortURL creates short URL and return it in full version
-func (sa *ShortenerApp) CreateShortURL(url string, userID int) (string, error) {
-	shortURL := sa.makeShortURL(url)
-	err := sa.Storage.AddItem(url, shortURL, userID)
+// CreateShortURL creates short URL and return it in full version. If alias is not empty, it is used as short URL.
+// Zero expiresAt means that short URL never expires. If URL was shortened before, storage.ErrAlreadyExist is returned,
+// or ErrAliasURLExists if alias was requested
+func (sa *ShortenerApp) CreateShortURL(ctx context.Context, url string, alias string, expiresAt time.Time, userID int64) (string, error) {
+	url, err := sa.NormalizeURL(url)
 	if err != nil {
 		return "", err
 	}
-	outputFullShortURL := fmt.Sprintf("%s/%s", sa.BaseAddress, shortURL)
+	if err := sa.checkDomain(url); err != nil {
+		return "", err
+	}
+	if alias != "" {
+		return sa.createAliasURL(ctx, url, alias, expiresAt, userID)
+	}
+	return sa.createGeneratedURL(ctx, url, expiresAt, userID)
+}
+
+// createGeneratedURL stores normalized URL with generated short URL. Generation is repeated after collisions
+func (sa *ShortenerApp) createGeneratedURL(ctx context.Context, url string, expiresAt time.Time, userID int64) (string, error) {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		shortURL, err := sa.makeShortURL(url, attempt)
+		if err != nil {
+			return "", err
+		}
+		err = sa.Storage.AddItem(ctx, url, shortURL, expiresAt, userID)
+		if err != nil {
+			if errors.Is(err, storage.ErrShortURLCollision) {
+				log.Printf("Short URL collision. Short URL:%s|Original URL:%s|Attempt:%d\n", shortURL, url, attempt)
+				continue
+			}
+			return "", err
+		}
+		outputFullShortURL := fmt.Sprintf("%s/%s", sa.BaseAddress, shortURL)
+		return outputFullShortURL, nil
+	}
+	return "", ErrCantGenerateShortURL
+}
+
+func (sa *ShortenerApp) createAliasURL(ctx context.Context, url string, alias string, expiresAt time.Time, userID int64) (string, error) {
+	if err := ValidateAlias(alias); err != nil {
+		return "", err
+	}
+	err := sa.Storage.AddItem(ctx, url, alias, expiresAt, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrShortURLCollision) {
+			return "", ErrAliasTaken
+		}
+		if errors.Is(err, storage.ErrAlreadyExist) {
+			return "", ErrAliasURLExists
+		}
+		return "", err
+	}
+	outputFullShortURL := fmt.Sprintf("%s/%s", sa.BaseAddress, alias)
 	return outputFullShortURL, nil
 }
 
-// CreateShortURLs creates short URLs for batch of URLs. Short URLs will return in same sequence
-func (sa *ShortenerApp) CreateShortURLs(urls []string, userID int) ([]string, error) {
+// ShortURLResult is the result of shortening of one URL from batch. Created is false
+// if URL was shortened before, ShortURL contains existing short URL in this case.
+// Err is set if URL was not accepted for shortening
+type ShortURLResult struct {
+	ShortURL string
+	Created  bool
+	Err      error
+}
+
+// CreateShortURLs creates short URLs for batch of URLs. Results will return in same sequence.
+// Elements of expiresAt correspond to URLs, zero time means that short URL never expires.
+// Invalid URLs and URLs, which can't be stored, are reported in results and don't prevent shortening of other URLs
+func (sa *ShortenerApp) CreateShortURLs(ctx context.Context, urls []string, expiresAt []time.Time, userID int64) []ShortURLResult {
+	results := make([]ShortURLResult, len(urls))
+	var validURLs []string
+	var validExpiresAt []time.Time
 	var shortURLs []string
-	for _, URL := range urls {
-		shortURLs = append(shortURLs, sa.makeShortURL(URL))
+	var validIdx []int
+	usedInBatch := make(map[string]bool)
+	for i, URL := range urls {
+		URL, err := sa.NormalizeURL(URL)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if err := sa.checkDomain(URL); err != nil {
+			results[i].Err = err
+			continue
+		}
+		shortURL, err := sa.makeFreeShortURL(ctx, URL, usedInBatch)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		usedInBatch[shortURL] = true
+		shortURLs = append(shortURLs, shortURL)
+		validURLs = append(validURLs, URL)
+		validExpiresAt = append(validExpiresAt, expiresAt[i])
+		validIdx = append(validIdx, i)
 	}
-	err := sa.Storage.AddBatchItems(urls, shortURLs, userID)
+	if len(validURLs) == 0 {
+		return results
+	}
+	itemResults, err := sa.Storage.AddBatchItems(ctx, validURLs, shortURLs, validExpiresAt, userID)
 	if err != nil {
-		return make([]string, 0), err
+		// Batch is added atomically, so one failed item fails the whole batch. Items are added one by one then,
+		// and every item gets its own result
+		log.Printf("Cannot add batch, adding items one by one. Error message:%s\n", err.Error())
+		for j, i := range validIdx {
+			results[i] = sa.createBatchItem(ctx, validURLs[j], validExpiresAt[j], userID)
+		}
+		return results
 	}
-	var fullShortURLs []string
-	for _, shortURL := range shortURLs {
-		fullShortURLs = append(fullShortURLs, fmt.Sprintf("%s/%s", sa.BaseAddress, shortURL))
+	for j, itemRes := range itemResults {
+		results[validIdx[j]] = ShortURLResult{fmt.Sprintf("%s/%s", sa.BaseAddress, itemRes.Item), itemRes.Created, nil}
 	}
-	return fullShortURLs, nil
+	return results
 }
 
-func (sa *ShortenerApp) GetOrigURL(shortURL string) (string, error) {
-	itemRes, err := sa.Storage.GetItem(shortURL)
+// createBatchItem creates short URL for normalized URL of batch separately from other items
+func (sa *ShortenerApp) createBatchItem(ctx context.Context, url string, expiresAt time.Time, userID int64) ShortURLResult {
+	shortURL, err := sa.createGeneratedURL(ctx, url, expiresAt, userID)
+	if err == nil {
+		return ShortURLResult{shortURL, true, nil}
+	}
+	if !errors.Is(err, storage.ErrAlreadyExist) {
+		return ShortURLResult{Err: err}
+	}
+	shortURL, err = sa.GetExistShortURL(ctx, url)
+	if err != nil {
+		return ShortURLResult{Err: err}
+	}
+	return ShortURLResult{shortURL, false, nil}
+}
+
+func (sa *ShortenerApp) GetOrigURL(ctx context.Context, shortURL string) (string, error) {
+	itemRes, err := sa.Storage.GetItem(ctx, shortURL)
 	if err != nil {
 		if errors.Is(err, storage.ErrEmptyResult) {
 			return "", ErrCantFindURL
@@ -56,11 +174,22 @@ func (sa *ShortenerApp) GetOrigURL(shortURL string) (string, error) {
 	if itemRes.HaveDeletedFlag {
 		return "", ErrURLDeleted
 	}
+	if !itemRes.ExpiresAt.IsZero() && !time.Now().Before(itemRes.ExpiresAt) {
+		return "", ErrURLExpired
+	}
+	// Links created before domain was denied must not redirect
+	if err := sa.checkDomain(itemRes.Item); err != nil {
+		return "", err
+	}
 	return itemRes.Item, nil
 }
 
-func (sa *ShortenerApp) GetExistShortURL(origURL string) (string, error) {
-	itemRes, err := sa.Storage.GetItemByID(origURL)
+// GetExistShortURL returns short URL, which was made for origURL before. origURL is normalized as in CreateShortURL
+func (sa *ShortenerApp) GetExistShortURL(ctx context.Context, origURL string) (string, error) {
+	if normalized, err := sa.NormalizeURL(origURL); err == nil {
+		origURL = normalized
+	}
+	itemRes, err := sa.Storage.GetItemByID(ctx, origURL)
 	if err != nil {
 		if errors.Is(err, storage.ErrEmptyResult) {
 			return "", ErrCantFindURL
@@ -74,10 +203,10 @@ func (sa *ShortenerApp) GetExistShortURL(origURL string) (string, error) {
 	return outputFullShortURL, nil
 }
 
-func (sa *ShortenerApp) ShortURLExist(shortURL string) (bool, error) {
+func (sa *ShortenerApp) ShortURLExist(ctx context.Context, shortURL string) (bool, error) {
 	// До конца не уверен, что использовать error в рамках штатной работы алгоритма является хорошей идеей,
 	// но пока не успеваю обдумать другие варианты
-	_, err := sa.Storage.GetItem(shortURL)
+	_, err := sa.Storage.GetItem(ctx, shortURL)
 	if err != nil {
 		if errors.Is(err, storage.ErrEmptyResult) {
 			return false, nil
@@ -87,8 +216,8 @@ func (sa *ShortenerApp) ShortURLExist(shortURL string) (bool, error) {
 	return true, nil
 }
 
-func (sa *ShortenerApp) GetHistoryURLsForUser(userID int) ([]byte, error) {
-	history, err := sa.Storage.GetUserHistory(userID)
+func (sa *ShortenerApp) GetHistoryURLsForUser(ctx context.Context, userID int64) ([]byte, error) {
+	history, err := sa.Storage.GetUserHistory(ctx, userID)
 	if err != nil {
 		return make([]byte, 0), err
 	}
@@ -103,8 +232,8 @@ func (sa *ShortenerApp) GetHistoryURLsForUser(userID int) ([]byte, error) {
 	return historyByJSON, nil
 }
 
-func (sa *ShortenerApp) UserHaveURLinHistory(userID int, URL string) (bool, error) {
-	history, err := sa.Storage.GetUserHistory(userID)
+func (sa *ShortenerApp) UserHaveURLinHistory(ctx context.Context, userID int64, URL string) (bool, error) {
+	history, err := sa.Storage.GetUserHistory(ctx, userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrEmptyResult) {
 			return false, nil
@@ -119,8 +248,8 @@ func (sa *ShortenerApp) UserHaveURLinHistory(userID int, URL string) (bool, erro
 	return false, nil
 }
 
-func (sa *ShortenerApp) UserHaveHistoryURLs(userID int) (bool, error) {
-	history, err := sa.Storage.GetUserHistory(userID)
+func (sa *ShortenerApp) UserHaveHistoryURLs(ctx context.Context, userID int64) (bool, error) {
+	history, err := sa.Storage.GetUserHistory(ctx, userID)
 	if err != nil {
 		if errors.Is(err, storage.ErrEmptyResult) {
 			return false, nil
@@ -131,12 +260,102 @@ func (sa *ShortenerApp) UserHaveHistoryURLs(userID int) (bool, error) {
 	return true, nil
 }
 
-func (sa *ShortenerApp) MarkDeleteBatchURLs(urls []string) error {
-	err := sa.Storage.MarkDeleteBatchItems(urls)
+func (sa *ShortenerApp) MarkDeleteBatchURLs(ctx context.Context, urls []string) error {
+	err := sa.Storage.MarkDeleteBatchItems(ctx, urls)
 	return err
 }
 
-func (sa *ShortenerApp) makeShortURL(url string) string {
-	crc := crc32.ChecksumIEEE([]byte(url))
-	return fmt.Sprint(crc)
+// RecordClick records redirect by short URL in background
+func (sa *ShortenerApp) RecordClick(event storage.ClickEvent) {
+	if sa.Clicks == nil {
+		return
+	}
+	sa.Clicks.Record(event)
+}
+
+// GetClickStats returns statistics of clicks by short URL. Statistics are available only for users
+// who have short URL in history, ErrCantFindURL is returned for others
+func (sa *ShortenerApp) GetClickStats(ctx context.Context, userID int64, shortURL string) (*storage.ClickStats, error) {
+	owned, err := sa.UserHaveURLinHistory(ctx, userID, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	if !owned {
+		return nil, ErrCantFindURL
+	}
+	return sa.Storage.GetClickStats(ctx, shortURL)
+}
+
+// MarkDeleteExpiredURLs marks as deleted short URLs which are expired at the moment
+func (sa *ShortenerApp) MarkDeleteExpiredURLs(ctx context.Context) (int, error) {
+	return sa.Storage.MarkDeleteExpiredItems(ctx, time.Now())
+}
+
+// ExpirationTime calculates expiration time from absolute time or TTL in seconds. Only one of them may be set.
+// Zero time is returned if none of them is set
+func ExpirationTime(expiresAt *time.Time, ttlSeconds int64) (time.Time, error) {
+	if expiresAt != nil && ttlSeconds != 0 {
+		return time.Time{}, fmt.Errorf("%w: expires_at and ttl_seconds can't be set together", ErrInvalidExpiration)
+	}
+	if ttlSeconds < 0 {
+		return time.Time{}, fmt.Errorf("%w: ttl_seconds must be positive", ErrInvalidExpiration)
+	}
+	if ttlSeconds > 0 {
+		return time.Now().Add(time.Duration(ttlSeconds) * time.Second), nil
+	}
+	if expiresAt != nil {
+		if !expiresAt.After(time.Now()) {
+			return time.Time{}, fmt.Errorf("%w: expires_at must be in future", ErrInvalidExpiration)
+		}
+		return *expiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
+// NormalizeURL validates and normalizes URL according to URL policy of application
+func (sa *ShortenerApp) NormalizeURL(url string) (string, error) {
+	if sa.URLPolicy == nil {
+		return DefaultURLPolicy().Normalize(url)
+	}
+	return sa.URLPolicy.Normalize(url)
+}
+
+func (sa *ShortenerApp) checkDomain(url string) error {
+	if sa.DomainPolicy == nil {
+		return nil
+	}
+	return sa.DomainPolicy.Check(url)
+}
+
+func (sa *ShortenerApp) makeShortURL(url string, attempt int) (string, error) {
+	if sa.Generator == nil {
+		return defaultGenerator.Generate(url, attempt)
+	}
+	return sa.Generator.Generate(url, attempt)
+}
+
+// makeFreeShortURL makes short URL which is not taken by another original URL in storage or in current batch.
+// If URL was shortened before with the same code, this code is returned
+func (sa *ShortenerApp) makeFreeShortURL(ctx context.Context, url string, usedInBatch map[string]bool) (string, error) {
+	for attempt := 0; attempt < maxGenerateAttempts; attempt++ {
+		shortURL, err := sa.makeShortURL(url, attempt)
+		if err != nil {
+			return "", err
+		}
+		if usedInBatch[shortURL] {
+			continue
+		}
+		itemRes, err := sa.Storage.GetItem(ctx, shortURL)
+		if err != nil {
+			if errors.Is(err, storage.ErrEmptyResult) {
+				return shortURL, nil
+			}
+			return "", err
+		}
+		if itemRes.Item == url {
+			return shortURL, nil
+		}
+		log.Printf("Short URL collision. Short URL:%s|Original URL:%s|Attempt:%d\n", shortURL, url, attempt)
+	}
+	return "", ErrCantGenerateShortURL
 }
@@ -2,6 +2,8 @@ package app_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/ffrxp/go-practicum/internal/app"
 	"github.com/ffrxp/go-practicum/internal/common"
@@ -9,26 +11,44 @@ import (
 	"github.com/ffrxp/go-practicum/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func testRequest(t *testing.T, ts *httptest.Server, method, contentType, path string, content []byte) (*http.Response, string) {
+func testRequest(t *testing.T, ts *httptest.Server, method, contentType, path string, content []byte, header http.Header) (*http.Response, string) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return testClientRequest(t, client, ts, method, contentType, path, content, header)
+}
+
+// testClientRequest works like testRequest, but sends request by client, so cookies of client are used
+func testClientRequest(t *testing.T, client *http.Client, ts *httptest.Server, method, contentType, path string, content []byte,
+	header http.Header) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, bytes.NewBuffer(content))
 	require.NoError(t, err)
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	if contentType != "" {
 		req.Header.Set("content-type", contentType)
 	}
 
-	client := http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
 	resp, errDoReq := client.Do(req)
 	require.NoError(t, errDoReq)
+	defer resp.Body.Close()
 
 	respBody, errRead := ioutil.ReadAll(resp.Body)
 
@@ -37,8 +57,48 @@ func testRequest(t *testing.T, ts *httptest.Server, method, contentType, path st
 	return resp, string(respBody)
 }
 
+// bearer returns header with bearer token of API key or admin API
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+// newCookieClient returns client, which keeps cookies between requests
+func newCookieClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	return &http.Client{Jar: jar}
+}
+
+// testServer is a server with in-memory storage. Short codes are made by attemptGenerator
+type testServer struct {
+	*httptest.Server
+	app     *app.ShortenerApp
+	storage storage.Repository
+	handler interface {
+		Shutdown(ctx context.Context) error
+	}
+}
+
+// newTestServer starts server with given config. Server, its workers and storage are stopped on cleanup of test
+func newTestServer(t *testing.T, config *common.Config) *testServer {
+	appStorage := storage.NewDataStorage("")
+	t.Cleanup(func() {
+		appStorage.Close()
+	})
+	sa := &app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{}}
+	h, err := handlers.NewShortenerHandler(sa, config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		h.Shutdown(context.Background())
+	})
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &testServer{Server: ts, app: sa, storage: appStorage, handler: h}
+}
+
 func TestRouter(t *testing.T) {
-	config := common.InitConfig()
+	config, err := common.InitConfig()
+	require.NoError(t, err)
 
 	type Want struct {
 		code        int
@@ -71,20 +131,20 @@ func TestRouter(t *testing.T) {
 			name:        "POST test #1",
 			method:      "POST",
 			target:      "/",
-			content:     "yandex.com",
+			content:     "https://yandex.com",
 			contentType: "",
 			want: Want{
 				code:        201,
 				location:    "",
 				contentType: "",
-				response:    fmt.Sprintf("%s/1389853602", config.BaseAddress),
+				response:    fmt.Sprintf("%s/%d", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://yandex.com"))),
 			},
 		},
 		{
 			name:        "POST test #2",
 			method:      "POST",
 			target:      "/qwqwqqwqwqwqw",
-			content:     "yandex.com",
+			content:     "https://yandex.com",
 			contentType: "",
 			want: Want{
 				code:        400,
@@ -96,12 +156,12 @@ func TestRouter(t *testing.T) {
 		{
 			name:        "GET test #2",
 			method:      "GET",
-			target:      "/1389853602",
+			target:      fmt.Sprintf("/%d", crc32.ChecksumIEEE([]byte("https://yandex.com"))),
 			content:     "",
 			contentType: "",
 			want: Want{
 				code:        307,
-				location:    "yandex.com",
+				location:    "https://yandex.com",
 				contentType: "",
 				response:    "",
 			},
@@ -123,52 +183,170 @@ func TestRouter(t *testing.T) {
 			name:        "POST test #3 (JSON)",
 			method:      "POST",
 			target:      "/api/shorten",
-			content:     "{\"url\":\"ya.ru\"}",
+			content:     "{\"url\":\"https://ya.ru\"}",
 			contentType: "application/json",
 			want: Want{
 				code:        201,
 				location:    "",
 				contentType: "application/json",
-				response:    fmt.Sprintf("{\"result\":\"%s/3201241320\"}", config.BaseAddress),
+				response:    fmt.Sprintf("{\"result\":\"%s/%d\"}", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://ya.ru"))),
 			},
 		},
 		{
 			name:        "POST test #4 (batch)",
 			method:      "POST",
 			target:      "/api/shorten/batch",
-			content:     "[{\"correlation_id\":\"url1\",\"original_url\":\"stackoverflow.com\"},{\"correlation_id\":\"url2\",\"original_url\":\"go.dev\"}]",
+			content:     "[{\"correlation_id\":\"url1\",\"original_url\":\"https://stackoverflow.com\"},{\"correlation_id\":\"url2\",\"original_url\":\"https://go.dev\"}]",
 			contentType: "application/json",
 			want: Want{
 				code:        201,
 				location:    "",
 				contentType: "application/json",
-				response:    fmt.Sprintf("[{\"correlation_id\":\"url1\",\"short_url\":\"%s/2177322106\"},{\"correlation_id\":\"url2\",\"short_url\":\"%s/294555335\"}]", config.BaseAddress, config.BaseAddress),
+				response:    fmt.Sprintf("[{\"correlation_id\":\"url1\",\"short_url\":\"%s/%d\",\"status\":\"created\"},{\"correlation_id\":\"url2\",\"short_url\":\"%s/%d\",\"status\":\"created\"}]", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://stackoverflow.com")), config.BaseAddress, crc32.ChecksumIEEE([]byte("https://go.dev"))),
+			},
+		},
+		{
+			name:        "POST test #4.1 (batch with existing data)",
+			method:      "POST",
+			target:      "/api/shorten/batch",
+			content:     "[{\"correlation_id\":\"url1\",\"original_url\":\"https://stackoverflow.com\"},{\"correlation_id\":\"url3\",\"original_url\":\"https://golang.org\"}]",
+			contentType: "application/json",
+			want: Want{
+				code:        207,
+				location:    "",
+				contentType: "application/json",
+				response:    fmt.Sprintf("[{\"correlation_id\":\"url1\",\"short_url\":\"%s/%d\",\"status\":\"exists\"},{\"correlation_id\":\"url3\",\"short_url\":\"%s/%d\",\"status\":\"created\"}]", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://stackoverflow.com")), config.BaseAddress, crc32.ChecksumIEEE([]byte("https://golang.org"))),
+			},
+		},
+		{
+			name:        "POST test #4.2 (batch with invalid data)",
+			method:      "POST",
+			target:      "/api/shorten/batch",
+			content:     "[{\"correlation_id\":\"url4\",\"original_url\":\"\"},{\"correlation_id\":\"url5\",\"original_url\":\"https://go.dev/doc\",\"ttl_seconds\":-1}]",
+			contentType: "application/json",
+			want: Want{
+				code:        400,
+				location:    "",
+				contentType: "application/json",
+				response:    "[{\"correlation_id\":\"url4\",\"status\":\"invalid\",\"message\":\"app: invalid URL: URL is empty\"},{\"correlation_id\":\"url5\",\"status\":\"invalid\",\"message\":\"app: invalid expiration: ttl_seconds must be positive\"}]",
 			},
 		},
 		{
 			name:        "POST test #5 (request with existing data)",
 			method:      "POST",
 			target:      "/",
-			content:     "yandex.com",
+			content:     "https://yandex.com",
 			contentType: "",
 			want: Want{
 				code:        409,
 				location:    "",
 				contentType: "",
-				response:    fmt.Sprintf("%s/1389853602", config.BaseAddress),
+				response:    fmt.Sprintf("%s/%d", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://yandex.com"))),
 			},
 		},
 		{
 			name:        "POST test #6 (request JSON with existing data)",
 			method:      "POST",
 			target:      "/api/shorten",
-			content:     "{\"url\":\"ya.ru\"}",
+			content:     "{\"url\":\"https://ya.ru\"}",
+			contentType: "application/json",
+			want: Want{
+				code:        409,
+				location:    "",
+				contentType: "application/json",
+				response:    fmt.Sprintf("{\"result\":\"%s/%d\"}", config.BaseAddress, crc32.ChecksumIEEE([]byte("https://ya.ru"))),
+			},
+		},
+		{
+			name:        "POST test #7 (JSON with alias)",
+			method:      "POST",
+			target:      "/api/shorten",
+			content:     "{\"url\":\"https://shop.example.com/sale\",\"alias\":\"spring-sale\"}",
+			contentType: "application/json",
+			want: Want{
+				code:        201,
+				location:    "",
+				contentType: "application/json",
+				response:    fmt.Sprintf("{\"result\":\"%s/spring-sale\"}", config.BaseAddress),
+			},
+		},
+		{
+			name:        "GET test #4 (alias)",
+			method:      "GET",
+			target:      "/spring-sale",
+			content:     "",
+			contentType: "",
+			want: Want{
+				code:        307,
+				location:    "https://shop.example.com/sale",
+				contentType: "",
+				response:    "",
+			},
+		},
+		{
+			name:        "POST test #8 (JSON with taken alias)",
+			method:      "POST",
+			target:      "/api/shorten",
+			content:     "{\"url\":\"https://shop.example.com/other\",\"alias\":\"spring-sale\"}",
+			contentType: "application/json",
+			want: Want{
+				code:        409,
+				location:    "",
+				contentType: "application/json",
+				response:    "{\"error\":\"alias spring-sale is already taken\"}",
+			},
+		},
+		{
+			name:        "POST test #9 (JSON with reserved alias)",
+			method:      "POST",
+			target:      "/api/shorten",
+			content:     "{\"url\":\"https://shop.example.com/other\",\"alias\":\"api\"}",
+			contentType: "application/json",
+			want: Want{
+				code:        400,
+				location:    "",
+				contentType: "application/json",
+				response:    "{\"error\":\"invalid alias: api is reserved\"}",
+			},
+		},
+		{
+			name:        "POST test #9a (JSON with alias for shortened URL)",
+			method:      "POST",
+			target:      "/api/shorten",
+			content:     "{\"url\":\"https://shop.example.com/sale\",\"alias\":\"autumn-sale\"}",
 			contentType: "application/json",
 			want: Want{
 				code:        409,
 				location:    "",
 				contentType: "application/json",
-				response:    fmt.Sprintf("{\"result\":\"%s/3201241320\"}", config.BaseAddress),
+				response: fmt.Sprintf("{\"result\":\"%s/spring-sale\",\"error\":\"URL already has short URL, alias autumn-sale is not created\"}",
+					config.BaseAddress),
+			},
+		},
+		{
+			name:        "POST test #10 (URL without scheme)",
+			method:      "POST",
+			target:      "/",
+			content:     "yandex.com",
+			contentType: "",
+			want: Want{
+				code:        422,
+				location:    "",
+				contentType: "application/json",
+				response:    "{\"error\":\"app: invalid URL: URL has no scheme\",\"code\":\"missing_scheme\"}",
+			},
+		},
+		{
+			name:        "POST test #11 (JSON with forbidden scheme)",
+			method:      "POST",
+			target:      "/api/shorten",
+			content:     "{\"url\":\"javascript:alert(1)\"}",
+			contentType: "application/json",
+			want: Want{
+				code:        422,
+				location:    "",
+				contentType: "application/json",
+				response:    "{\"error\":\"app: invalid URL: scheme javascript is not allowed\",\"code\":\"forbidden_scheme\"}",
 			},
 		},
 	}
@@ -177,7 +355,8 @@ func TestRouter(t *testing.T) {
 	defer appStorage.Close()
 	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: config.BaseAddress}
 
-	h := handlers.NewShortenerHandler(&sa)
+	h, err := handlers.NewShortenerHandler(&sa, config)
+	require.NoError(t, err)
 	ts := httptest.NewServer(h)
 	defer ts.Close()
 
@@ -185,7 +364,7 @@ func TestRouter(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			require.Contains(t, []string{"GET", "POST"}, tt.method)
 
-			resp, respContent := testRequest(t, ts, tt.method, tt.contentType, tt.target, []byte(tt.content))
+			resp, respContent := testRequest(t, ts, tt.method, tt.contentType, tt.target, []byte(tt.content), nil)
 			defer resp.Body.Close()
 
 			assert.Equal(t, tt.want.code, resp.StatusCode)
@@ -200,3 +379,841 @@ func TestRouter(t *testing.T) {
 		})
 	}
 }
+
+type attemptGenerator struct{}
+
+func (g attemptGenerator) Generate(url string, attempt int) (string, error) {
+	return fmt.Sprintf("code%d", attempt), nil
+}
+
+func TestCreateShortURLCollision(t *testing.T) {
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{}}
+	ctx := context.Background()
+
+	first, err := sa.CreateShortURL(ctx, "https://first.example", "", time.Time{}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost/code0", first)
+
+	second, err := sa.CreateShortURL(ctx, "https://second.example", "", time.Time{}, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost/code1", second)
+
+	_, err = sa.CreateShortURL(ctx, "https://first.example", "", time.Time{}, 1)
+	assert.ErrorIs(t, err, storage.ErrAlreadyExist)
+
+	batch := sa.CreateShortURLs(ctx, []string{"https://third.example", "https://first.example"}, make([]time.Time, 2), 1)
+	assert.Equal(t, []app.ShortURLResult{{"http://localhost/code2", true, nil}, {"http://localhost/code0", false, nil}}, batch)
+}
+
+// stuckGenerator returns the same code for URLs of host stuck.example on every attempt
+type stuckGenerator struct{}
+
+func (g stuckGenerator) Generate(url string, attempt int) (string, error) {
+	if strings.Contains(url, "stuck.example") {
+		return "taken", nil
+	}
+	return fmt.Sprintf("%s-%d", strings.TrimPrefix(url, "https://"), attempt), nil
+}
+
+// failingBatchStorage fails every batch as storage does after race with another request
+type failingBatchStorage struct {
+	storage.Repository
+}
+
+func (s failingBatchStorage) AddBatchItems(ctx context.Context, ids []string, values []string, expiresAt []time.Time, userID int64) ([]storage.BatchItemResult, error) {
+	return nil, storage.ErrShortURLCollision
+}
+
+func TestCreateShortURLsPartialSuccess(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		wrapped func(storage.Repository) storage.Repository
+	}{
+		{name: "batch", wrapped: func(r storage.Repository) storage.Repository { return r }},
+		{name: "item by item", wrapped: func(r storage.Repository) storage.Repository { return failingBatchStorage{r} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			appStorage := storage.NewDataStorage("")
+			defer appStorage.Close()
+			require.NoError(t, appStorage.AddItem(ctx, "https://other.example", "taken", time.Time{}, 1))
+			sa := app.ShortenerApp{Storage: tt.wrapped(appStorage), BaseAddress: "http://localhost", Generator: stuckGenerator{}}
+
+			batch := sa.CreateShortURLs(ctx, []string{"https://stuck.example", "https://fine.example", "https://other.example"},
+				make([]time.Time, 3), 1)
+			require.Len(t, batch, 3)
+			assert.ErrorIs(t, batch[0].Err, app.ErrCantGenerateShortURL)
+			assert.Equal(t, app.ShortURLResult{ShortURL: "http://localhost/fine.example-0", Created: true}, batch[1])
+			assert.Equal(t, app.ShortURLResult{ShortURL: "http://localhost/taken"}, batch[2])
+		})
+	}
+}
+
+func TestShortCodeGenerators(t *testing.T) {
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	for _, kind := range []string{app.GeneratorHash, app.GeneratorCounter, app.GeneratorRandom} {
+		t.Run(kind, func(t *testing.T) {
+			gen, err := app.NewShortCodeGenerator(kind, "", appStorage)
+			require.NoError(t, err)
+			first, err := gen.Generate("https://example.com", 0)
+			require.NoError(t, err)
+			second, err := gen.Generate("https://example.com", 1)
+			require.NoError(t, err)
+			assert.NotEmpty(t, first)
+			assert.NotEqual(t, first, second)
+		})
+	}
+	_, err := app.NewShortCodeGenerator("unknown", "", appStorage)
+	assert.ErrorIs(t, err, app.ErrUnknownGenerator)
+}
+
+func TestCounterGeneratorRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	ctx := context.Background()
+	created := make(map[string]bool)
+	for restart := 0; restart < 3; restart++ {
+		appStorage := storage.NewDataStorage(path)
+		gen, err := app.NewShortCodeGenerator(app.GeneratorCounter, "", appStorage)
+		require.NoError(t, err)
+		sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: gen}
+		for i := 0; i < 20; i++ {
+			shortURL, err := sa.CreateShortURL(ctx, fmt.Sprintf("https://example.com/%d/%d", restart, i), "", time.Time{}, 1)
+			require.NoError(t, err)
+			assert.False(t, created[shortURL])
+			created[shortURL] = true
+		}
+		require.NoError(t, appStorage.Close())
+	}
+}
+
+// fixedCounterStore reserves ranges of counter starting from next
+type fixedCounterStore struct {
+	next uint64
+}
+
+func (s *fixedCounterStore) ReserveCounterRange(ctx context.Context, size uint64) (uint64, error) {
+	first := s.next
+	s.next += size
+	return first, nil
+}
+
+func TestCounterGeneratorSkipsReservedCodes(t *testing.T) {
+	// 40008 is "api" in base62
+	gen, err := app.NewShortCodeGenerator(app.GeneratorCounter, "", &fixedCounterStore{next: 40007})
+	require.NoError(t, err)
+	var codes []string
+	for i := 0; i < 2; i++ {
+		code, err := gen.Generate("https://example.com", 0)
+		require.NoError(t, err)
+		codes = append(codes, code)
+	}
+	assert.Equal(t, []string{"aph", "apj"}, codes)
+}
+
+func TestExpiration(t *testing.T) {
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{}}
+	ctx := context.Background()
+
+	expiresAt, err := app.ExpirationTime(nil, 1)
+	require.NoError(t, err)
+	_, err = sa.CreateShortURL(ctx, "https://expiring.example", "", expiresAt, 1)
+	require.NoError(t, err)
+	_, err = sa.CreateShortURL(ctx, "https://eternal.example", "", time.Time{}, 1)
+	require.NoError(t, err)
+
+	origURL, err := sa.GetOrigURL(ctx, "code0")
+	require.NoError(t, err)
+	assert.Equal(t, "https://expiring.example", origURL)
+
+	time.Sleep(time.Until(expiresAt))
+	_, err = sa.GetOrigURL(ctx, "code0")
+	assert.ErrorIs(t, err, app.ErrURLExpired)
+
+	marked, err := sa.MarkDeleteExpiredURLs(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, marked)
+	_, err = sa.GetOrigURL(ctx, "code0")
+	assert.ErrorIs(t, err, app.ErrURLDeleted)
+	_, err = sa.GetOrigURL(ctx, "code1")
+	assert.NoError(t, err)
+
+	past := time.Now().Add(-time.Hour)
+	_, err = app.ExpirationTime(&past, 0)
+	assert.ErrorIs(t, err, app.ErrInvalidExpiration)
+	_, err = app.ExpirationTime(&expiresAt, 10)
+	assert.ErrorIs(t, err, app.ErrInvalidExpiration)
+}
+
+func TestNormalizeURL(t *testing.T) {
+	policy := app.DefaultURLPolicy()
+	tests := []struct {
+		name    string
+		policy  app.URLPolicy
+		url     string
+		want    string
+		errCode string
+	}{
+		{name: "lowercase scheme and host", policy: *policy, url: " HTTPS://Example.COM/Path?q=A ", want: "https://example.com/Path?q=A"},
+		{name: "default port", policy: *policy, url: "http://example.com:80/", want: "http://example.com/"},
+		{name: "custom port", policy: *policy, url: "https://example.com:8443/", want: "https://example.com:8443/"},
+		{name: "IDN host", policy: *policy, url: "https://пример.рф/путь", want: "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C"},
+		{name: "IPv6 host", policy: *policy, url: "http://[::1]:80/", want: "http://[::1]/"},
+		{name: "fragment kept", policy: *policy, url: "https://example.com/#top", want: "https://example.com/#top"},
+		{name: "fragment stripped", policy: app.URLPolicy{AllowedSchemes: []string{"https"}, StripFragment: true},
+			url: "https://example.com/#top", want: "https://example.com/"},
+		{name: "default scheme", policy: app.URLPolicy{AllowedSchemes: []string{"http"}, DefaultScheme: "http"},
+			url: "localhost:8080/path", want: "http://localhost:8080/path"},
+		{name: "empty", policy: *policy, url: "  ", errCode: app.URLErrEmpty},
+		{name: "missing scheme", policy: *policy, url: "example.com", errCode: app.URLErrMissingScheme},
+		{name: "javascript", policy: *policy, url: "javascript:alert(1)", errCode: app.URLErrForbiddenScheme},
+		{name: "data", policy: *policy, url: "data:text/html,<script>alert(1)</script>", errCode: app.URLErrForbiddenScheme},
+		{name: "no host", policy: *policy, url: "https:///path", errCode: app.URLErrInvalidHost},
+		{name: "malformed", policy: *policy, url: "https://exa mple.com/%zz", errCode: app.URLErrMalformed},
+		{name: "too long", policy: app.URLPolicy{AllowedSchemes: []string{"https"}, MaxLength: 20},
+			url: "https://example.com/long", errCode: app.URLErrTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Normalize(tt.url)
+			if tt.errCode != "" {
+				var validationErr *app.URLValidationError
+				require.ErrorAs(t, err, &validationErr)
+				assert.Equal(t, tt.errCode, validationErr.Code)
+				assert.ErrorIs(t, err, app.ErrInvalidURL)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDomainPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	rules := `# phishing
+deny suffix evil.example
+deny regex ^login-.*\.example$
+deny exact bad.example
+deny suffix Пример.рф
+deny regex ^PAY-.*\.example$
+`
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0666))
+	policy, err := app.NewDomainPolicy(path)
+	require.NoError(t, err)
+
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{},
+		DomainPolicy: policy}
+	ctx := context.Background()
+
+	for _, blocked := range []string{"https://evil.example", "https://www.evil.example/path", "https://login-bank.example",
+		"https://BAD.example", "https://www.пример.рф/путь", "https://xn--e1afmkfd.xn--p1ai", "https://pay-now.example"} {
+		_, err = sa.CreateShortURL(ctx, blocked, "", time.Time{}, 1)
+		assert.ErrorIs(t, err, app.ErrDomainBlocked, blocked)
+	}
+	_, err = sa.CreateShortURL(ctx, "https://notevil.example", "", time.Time{}, 1)
+	require.NoError(t, err)
+	batch := sa.CreateShortURLs(ctx, []string{"https://sub.bad.example", "https://evil.example"}, make([]time.Time, 2), 1)
+	assert.NoError(t, batch[0].Err)
+	assert.ErrorIs(t, batch[1].Err, app.ErrDomainBlocked)
+
+	// Links created before domain was denied stop redirecting after reload
+	require.NoError(t, os.WriteFile(path, []byte("allow suffix evil.example\n"), 0666))
+	require.NoError(t, policy.Reload())
+	_, err = sa.GetOrigURL(ctx, "code0")
+	assert.ErrorIs(t, err, app.ErrDomainBlocked)
+	_, err = sa.CreateShortURL(ctx, "https://www.evil.example", "", time.Time{}, 1)
+	assert.NoError(t, err)
+
+	// Invalid file doesn't replace current rules
+	require.NoError(t, os.WriteFile(path, []byte("deny unknown evil.example\n"), 0666))
+	assert.Error(t, policy.Reload())
+	assert.NoError(t, policy.Check("https://evil.example"))
+
+	reload := make(chan os.Signal, 1)
+	watchCtx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	go policy.Watch(watchCtx, time.Hour, reload)
+	require.NoError(t, os.WriteFile(path, []byte("deny exact evil.example\n"), 0666))
+	reload <- os.Interrupt
+	assert.Eventually(t, func() bool {
+		return policy.Check("https://evil.example") != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestClickStats(t *testing.T) {
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	clicks := app.NewClickRecorder(appStorage, 0)
+	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{},
+		Clicks: clicks}
+	ctx := context.Background()
+
+	_, err := sa.CreateShortURL(ctx, "https://example.com", "", time.Time{}, 1)
+	require.NoError(t, err)
+	day := time.Date(2022, 5, 1, 23, 0, 0, 0, time.UTC)
+	for _, clickTime := range []time.Time{day, day.Add(30 * time.Minute), day.Add(2 * time.Hour)} {
+		sa.RecordClick(storage.ClickEvent{ShortURL: "code0", Time: clickTime, Referrer: "https://ref.example"})
+	}
+	clicks.Close()
+	// Late clicks after shutdown are dropped
+	sa.RecordClick(storage.ClickEvent{ShortURL: "code0", Time: day})
+
+	stats, err := sa.GetClickStats(ctx, 1, "code0")
+	require.NoError(t, err)
+	assert.Equal(t, &storage.ClickStats{Total: 3, Daily: []storage.DailyClicks{{Date: "2022-05-01", Clicks: 2}, {Date: "2022-05-02", Clicks: 1}}}, stats)
+	_, err = sa.GetClickStats(ctx, 2, "code0")
+	assert.ErrorIs(t, err, app.ErrCantFindURL)
+}
+
+func TestShutdownDrainsDeleteQueue(t *testing.T) {
+	srv := newTestServer(t, common.DefaultConfig())
+	client := newCookieClient(t)
+	resp, _ := testClientRequest(t, client, srv.Server, http.MethodPost, "text/plain", "/", []byte("https://example.com"), nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = testClientRequest(t, client, srv.Server, http.MethodDelete, "application/json", "/api/user/urls", []byte(`["code0"]`), nil)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Pending batch is flushed on shutdown without waiting for ticker of worker
+	require.NoError(t, srv.handler.Shutdown(context.Background()))
+	_, err := srv.app.GetOrigURL(context.Background(), "code0")
+	assert.ErrorIs(t, err, app.ErrURLDeleted)
+}
+
+func TestCookieKeyRotation(t *testing.T) {
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	sa := app.ShortenerApp{Storage: appStorage, BaseAddress: "http://localhost", Generator: attemptGenerator{}}
+	newServer := func(secretKey string, previousKeys string) *httptest.Server {
+		config := common.DefaultConfig()
+		config.SecretKey = secretKey
+		config.PreviousSecretKeys = previousKeys
+		h, err := handlers.NewShortenerHandler(&sa, config)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			h.Shutdown(context.Background())
+		})
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	getUserURLs := func(ts *httptest.Server, cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/user/urls", nil)
+		require.NoError(t, err)
+		req.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	oldServer := newServer("old", "")
+	resp, err := http.Post(oldServer.URL+"/", "text/plain", strings.NewReader("https://example.com"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	oldCookie := resp.Cookies()[0]
+
+	// Cookie signed with previous key is accepted and replaced with cookie signed with primary key
+	resp = getUserURLs(newServer("new", "old"), oldCookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	newCookie := resp.Cookies()[0]
+	assert.NotEqual(t, oldCookie.Value, newCookie.Value)
+
+	// After retirement of old key, only new cookie is accepted
+	retiredServer := newServer("new", "")
+	assert.Equal(t, http.StatusNoContent, getUserURLs(retiredServer, oldCookie).StatusCode)
+	assert.Equal(t, http.StatusOK, getUserURLs(retiredServer, newCookie).StatusCode)
+}
+
+func TestUserTokenRenewal(t *testing.T) {
+	config := common.DefaultConfig()
+	config.SecretKey = "key"
+	config.CookieTTL = time.Hour
+	srv := newTestServer(t, config)
+	keyring, err := config.LoadKeyring()
+	require.NoError(t, err)
+
+	now := time.Now()
+	userID, err := srv.storage.CreateUser(context.Background(), now.Add(-3*time.Hour))
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		userID   int64
+		issuedAt time.Time
+		// ttl of token, zero means TTL from config
+		ttl      time.Duration
+		renewed  bool
+		sameUser bool
+	}{
+		{name: "fresh token", userID: userID, issuedAt: now, renewed: false, sameUser: true},
+		{name: "half of lifetime passed", userID: userID, issuedAt: now.Add(-40 * time.Minute), renewed: true, sameUser: true},
+		{name: "expired token", userID: userID, issuedAt: now.Add(-2 * time.Hour), renewed: true, sameUser: false},
+		{name: "unknown user", userID: userID + 100, issuedAt: now, renewed: true, sameUser: false},
+		{name: "token issued before registration", userID: userID, issuedAt: now.Add(-4 * time.Hour), ttl: 5 * time.Hour,
+			renewed: true, sameUser: false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl := tt.ttl
+			if ttl == 0 {
+				ttl = config.CookieTTL
+			}
+			token, err := common.NewUserToken(tt.userID, tt.issuedAt, ttl)
+			require.NoError(t, err)
+			value, err := keyring.EncodeUserToken(token)
+			require.NoError(t, err)
+
+			// Registry of users is checked only when user makes something
+			resp, _ := testRequest(t, srv.Server, http.MethodPost, "text/plain", "/", []byte(fmt.Sprintf("https://example.com/%d", i)),
+				http.Header{"Cookie": []string{"token=" + value}})
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			require.Len(t, resp.Cookies(), 1)
+			cookie := resp.Cookies()[0]
+			assert.True(t, cookie.HttpOnly)
+			assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+			assert.False(t, cookie.Secure)
+			assert.Equal(t, tt.renewed, cookie.Value != value)
+			decoded, _, err := keyring.DecodeUserToken(cookie.Value, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, tt.sameUser, decoded.UserID == tt.userID)
+			if tt.renewed {
+				assert.InDelta(t, config.CookieTTL.Seconds(), cookie.MaxAge, 5)
+			}
+		})
+	}
+
+	// Visitor gets token without user, user is registered on the first link
+	client := newCookieClient(t)
+	resp, _ := testClientRequest(t, client, srv.Server, http.MethodGet, "", "/api/user/urls", nil, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	decoded, _, err := keyring.DecodeUserToken(resp.Cookies()[0].Value, time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, decoded.UserID)
+	resp, _ = testClientRequest(t, client, srv.Server, http.MethodPost, "text/plain", "/", []byte("https://visitor.example"), nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	decoded, _, err = keyring.DecodeUserToken(resp.Cookies()[0].Value, time.Now())
+	require.NoError(t, err)
+	assert.NotZero(t, decoded.UserID)
+	resp, _ = testClientRequest(t, client, srv.Server, http.MethodGet, "", "/api/user/urls", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	config := common.DefaultConfig()
+	config.AdminToken = "admin"
+	srv := newTestServer(t, config)
+	sa := srv.app
+
+	userID, err := sa.CreateUser(context.Background())
+	require.NoError(t, err)
+	keyRequest := fmt.Sprintf(`{"user_id":%d}`, userID)
+	resp, _ := testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/keys", []byte(keyRequest), bearer("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/keys",
+		[]byte(fmt.Sprintf(`{"user_id":%d}`, userID+1)), bearer("admin"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, body := testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/keys", []byte(keyRequest), bearer("admin"))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var issued struct {
+		ID     string `json:"id"`
+		Key    string `json:"key"`
+		UserID int64  `json:"user_id"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &issued))
+	assert.Equal(t, userID, issued.UserID)
+
+	// Key takes precedence over cookie and no cookie is set for API clients
+	header := bearer(issued.Key)
+	header.Set("Cookie", "token=garbage")
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "text/plain", "/", []byte("https://example.com"), header)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Cookies())
+	owned, err := sa.UserHaveURLinHistory(context.Background(), userID, "code0")
+	require.NoError(t, err)
+	assert.True(t, owned)
+
+	resp, body = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/user/urls", nil, bearer(issued.Key))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "http://localhost/code0")
+
+	resp, _ = testRequest(t, srv.Server, http.MethodDelete, "application/json", "/api/admin/keys/"+issued.ID, nil, bearer("admin"))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodDelete, "application/json", "/api/admin/keys/unknown", nil, bearer("admin"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/user/urls", nil, bearer(issued.Key))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAccounts(t *testing.T) {
+	srv := newTestServer(t, common.DefaultConfig())
+	sa := srv.app
+
+	// Anonymous user becomes account on registration and keeps links
+	first := newCookieClient(t)
+	resp, _ := testClientRequest(t, first, srv.Server, http.MethodPost, "application/json", "/", []byte("https://first.example"), nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, body := testClientRequest(t, first, srv.Server, http.MethodPost, "application/json", "/api/user/register",
+		[]byte(`{"login":"Alice","password":"password1"}`), nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var account struct {
+		UserID int64 `json:"user_id"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &account))
+	owned, err := sa.UserHaveURLinHistory(context.Background(), account.UserID, "code0")
+	require.NoError(t, err)
+	assert.True(t, owned)
+
+	resp, _ = testClientRequest(t, newCookieClient(t), srv.Server, http.MethodPost, "application/json", "/api/user/register",
+		[]byte(`{"login":"alice","password":"password2"}`), nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = testClientRequest(t, newCookieClient(t), srv.Server, http.MethodPost, "application/json", "/api/user/register",
+		[]byte(`{"login":"bob","password":"short"}`), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Links of anonymous user are merged into account on login
+	second := newCookieClient(t)
+	resp, _ = testClientRequest(t, second, srv.Server, http.MethodPost, "application/json", "/", []byte("https://second.example"), nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = testClientRequest(t, second, srv.Server, http.MethodPost, "application/json", "/api/user/login",
+		[]byte(`{"login":"alice","password":"wrong-password"}`), nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, body = testClientRequest(t, second, srv.Server, http.MethodPost, "application/json", "/api/user/login",
+		[]byte(`{"login":"alice","password":"password1"}`), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, fmt.Sprintf(`{"user_id":%d}`, account.UserID), body)
+
+	resp, body = testClientRequest(t, second, srv.Server, http.MethodGet, "", "/api/user/urls", nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var history []storage.URLConversion
+	require.NoError(t, json.Unmarshal([]byte(body), &history))
+	assert.Len(t, history, 2)
+}
+
+func TestTransferURLs(t *testing.T) {
+	srv := newTestServer(t, common.DefaultConfig())
+	sa := srv.app
+	ctx := context.Background()
+
+	owner := newCookieClient(t)
+	for _, URL := range []string{"https://first.example", "https://second.example"} {
+		resp, _ := testClientRequest(t, owner, srv.Server, http.MethodPost, "text/plain", "/", []byte(URL), nil)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	recipientID, err := sa.CreateUser(ctx)
+	require.NoError(t, err)
+	keyHolderID, err := sa.CreateUser(ctx)
+	require.NoError(t, err)
+	key, err := sa.IssueAPIKey(ctx, keyHolderID)
+	require.NoError(t, err)
+	revokedKey, err := sa.IssueAPIKey(ctx, keyHolderID)
+	require.NoError(t, err)
+	require.NoError(t, sa.RevokeAPIKey(ctx, revokedKey.ID))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string
+		// wantOwner is the owner of short URLs after request, zero means that they stay with owner
+		wantOwner int64
+		shortURLs []string
+	}{
+		{name: "not owned short URL", body: fmt.Sprintf(`{"short_urls":["code0","missing"],"to_user_id":%d}`, recipientID),
+			wantStatus: http.StatusNotFound, shortURLs: []string{"code0"}},
+		// Unknown and forbidden recipients get the same response
+		{name: "unknown recipient", body: `{"short_urls":["code0"],"to_user_id":100}`,
+			wantStatus: http.StatusNotFound, wantBody: `{"error":"Cannot find user"}`, shortURLs: []string{"code0"}},
+		{name: "unknown API key", body: `{"short_urls":["code0"],"to_api_key_id":"unknown"}`,
+			wantStatus: http.StatusNotFound, wantBody: `{"error":"Cannot find user"}`, shortURLs: []string{"code0"}},
+		{name: "revoked API key", body: fmt.Sprintf(`{"short_urls":["code0"],"to_api_key_id":"%s"}`, revokedKey.ID),
+			wantStatus: http.StatusNotFound, wantBody: `{"error":"Cannot find user"}`, shortURLs: []string{"code0"}},
+		{name: "both recipients", body: fmt.Sprintf(`{"short_urls":["code0"],"to_user_id":%d,"to_api_key_id":"%s"}`, recipientID, key.ID),
+			wantStatus: http.StatusBadRequest, shortURLs: []string{"code0"}},
+		{name: "to user", body: fmt.Sprintf(`{"short_urls":["code0"],"to_user_id":%d}`, recipientID),
+			wantStatus: http.StatusOK, wantBody: fmt.Sprintf(`{"short_urls":["code0"],"to_user_id":%d}`, recipientID),
+			wantOwner: recipientID, shortURLs: []string{"code0"}},
+		{name: "to holder of API key", body: fmt.Sprintf(`{"short_urls":["code1"],"to_api_key_id":"%s"}`, key.ID),
+			wantStatus: http.StatusOK, wantBody: fmt.Sprintf(`{"short_urls":["code1"],"to_api_key_id":"%s"}`, key.ID),
+			wantOwner: keyHolderID, shortURLs: []string{"code1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := testClientRequest(t, owner, srv.Server, http.MethodPost, "application/json", "/api/user/urls/transfer",
+				[]byte(tt.body), nil)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, body)
+			}
+			if tt.wantOwner == 0 {
+				return
+			}
+			for _, shortURL := range tt.shortURLs {
+				owned, err := sa.UserHaveURLinHistory(ctx, tt.wantOwner, shortURL)
+				require.NoError(t, err)
+				assert.True(t, owned)
+			}
+		})
+	}
+	resp, _ := testClientRequest(t, owner, srv.Server, http.MethodGet, "", "/api/user/urls", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestWorkspaces(t *testing.T) {
+	srv := newTestServer(t, common.DefaultConfig())
+	sa := srv.app
+	ctx := context.Background()
+
+	keys := make(map[string]string)
+	userIDs := make(map[string]int64)
+	for _, name := range []string{"owner", "editor", "viewer", "outsider"} {
+		userID, err := sa.CreateUser(ctx)
+		require.NoError(t, err)
+		key, err := sa.IssueAPIKey(ctx, userID)
+		require.NoError(t, err)
+		keys[name] = key.Key
+		userIDs[name] = userID
+	}
+
+	resp, body := testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/user/workspaces", []byte(`{"name":"Team"}`),
+		bearer(keys["owner"]))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var workspace storage.WorkspaceMembership
+	require.NoError(t, json.Unmarshal([]byte(body), &workspace))
+	assert.Equal(t, app.RoleOwner, workspace.Role)
+	membersPath := fmt.Sprintf("/api/user/workspaces/%d/members/", workspace.ID)
+
+	tests := []struct {
+		name       string
+		user       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"add editor", "owner", http.MethodPut, membersPath + fmt.Sprint(userIDs["editor"]), `{"role":"editor"}`, http.StatusNoContent},
+		{"add viewer", "owner", http.MethodPut, membersPath + fmt.Sprint(userIDs["viewer"]), `{"role":"viewer"}`, http.StatusNoContent},
+		{"unknown user", "owner", http.MethodPut, membersPath + "100", `{"role":"viewer"}`, http.StatusNotFound},
+		{"unknown role", "owner", http.MethodPut, membersPath + fmt.Sprint(userIDs["outsider"]), `{"role":"admin"}`, http.StatusBadRequest},
+		{"viewer can't manage members", "viewer", http.MethodPut, membersPath + fmt.Sprint(userIDs["outsider"]), `{"role":"viewer"}`, http.StatusForbidden},
+		{"last owner can't leave", "owner", http.MethodDelete, membersPath + fmt.Sprint(userIDs["owner"]), "", http.StatusBadRequest},
+		{"editor creates link", "editor", http.MethodPost, "/api/shorten",
+			fmt.Sprintf(`{"url":"https://team.example","workspace_id":%d}`, workspace.ID), http.StatusCreated},
+		{"viewer can't create link", "viewer", http.MethodPost, "/api/shorten",
+			fmt.Sprintf(`{"url":"https://viewer.example","workspace_id":%d}`, workspace.ID), http.StatusForbidden},
+		{"outsider can't see workspace", "outsider", http.MethodGet, fmt.Sprintf("/api/user/urls?workspace_id=%d", workspace.ID), "", http.StatusNotFound},
+		{"viewer sees links", "viewer", http.MethodGet, fmt.Sprintf("/api/user/urls?workspace_id=%d", workspace.ID), "", http.StatusOK},
+		{"owner deletes link of editor", "owner", http.MethodDelete, "/api/user/urls", `["code0"]`, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := testRequest(t, srv.Server, tt.method, "application/json", tt.path, []byte(tt.body), bearer(keys[tt.user]))
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+
+	canDelete, err := sa.UserCanDeleteURL(ctx, userIDs["viewer"], "code0")
+	require.NoError(t, err)
+	assert.False(t, canDelete)
+
+	// URL shortened before by user is added to workspace, URL of another user is not
+	request := func(user, method, path, body string) int {
+		resp, _ := testRequest(t, srv.Server, method, "application/json", path, []byte(body), bearer(keys[user]))
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusCreated, request("editor", http.MethodPost, "/api/shorten", `{"url":"https://own.example"}`))
+	assert.Equal(t, http.StatusConflict, request("editor", http.MethodPost, "/api/shorten",
+		fmt.Sprintf(`{"url":"https://own.example","workspace_id":%d}`, workspace.ID)))
+	require.Equal(t, http.StatusCreated, request("outsider", http.MethodPost, "/api/shorten", `{"url":"https://outsider.example"}`))
+	assert.Equal(t, http.StatusForbidden, request("editor", http.MethodPost, "/api/shorten",
+		fmt.Sprintf(`{"url":"https://outsider.example","workspace_id":%d}`, workspace.ID)))
+
+	batchPath := fmt.Sprintf("/api/shorten/batch?workspace_id=%d", workspace.ID)
+	batch := `[{"correlation_id":"1","original_url":"https://batch.example"}]`
+	assert.Equal(t, http.StatusForbidden, request("viewer", http.MethodPost, batchPath, batch))
+	assert.Equal(t, http.StatusCreated, request("editor", http.MethodPost, batchPath, batch))
+	for shortURL, want := range map[string]bool{"code1": true, "code2": false, "code3": true} {
+		canDelete, err := sa.UserCanDeleteURL(ctx, userIDs["owner"], shortURL)
+		require.NoError(t, err)
+		assert.Equal(t, want, canDelete, shortURL)
+	}
+	require.NoError(t, srv.handler.Shutdown(ctx))
+	_, err = sa.GetOrigURL(ctx, "code0")
+	assert.ErrorIs(t, err, app.ErrURLDeleted)
+}
+
+// vanishingWorkspaceStorage behaves as storage, where workspaces are deleted right after check of rights
+type vanishingWorkspaceStorage struct {
+	storage.Repository
+}
+
+func (s vanishingWorkspaceStorage) SetWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, role string, ownerRole string) error {
+	return storage.ErrEmptyResult
+}
+
+func (s vanishingWorkspaceStorage) AddWorkspaceItems(ctx context.Context, workspaceID int64, shortURLs []string) error {
+	return storage.ErrEmptyResult
+}
+
+func TestVanishedWorkspace(t *testing.T) {
+	ctx := context.Background()
+	appStorage := storage.NewDataStorage("")
+	defer appStorage.Close()
+	sa := app.ShortenerApp{Storage: vanishingWorkspaceStorage{appStorage}, BaseAddress: "http://localhost", Generator: attemptGenerator{}}
+
+	ownerID, err := sa.CreateUser(ctx)
+	require.NoError(t, err)
+	memberID, err := sa.CreateUser(ctx)
+	require.NoError(t, err)
+	workspace, err := sa.CreateWorkspace(ctx, ownerID, "team")
+	require.NoError(t, err)
+	err = sa.SetWorkspaceMember(ctx, ownerID, workspace.ID, memberID, app.RoleViewer)
+	assert.ErrorIs(t, err, app.ErrCantFindWorkspace)
+
+	// Created short URLs are reported even if they can't be added to workspace
+	shortURL, err := sa.CreateWorkspaceShortURL(ctx, "https://first.example", "", time.Time{}, ownerID, workspace.ID)
+	assert.ErrorIs(t, err, app.ErrNotAddedToWorkspace)
+	assert.Equal(t, "http://localhost/code0", shortURL)
+	results, err := sa.CreateWorkspaceShortURLs(ctx, []string{"https://second.example"}, make([]time.Time, 1), ownerID, workspace.ID)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.ErrorIs(t, results[0].Err, app.ErrNotAddedToWorkspace)
+	assert.Equal(t, "http://localhost/code1", results[0].ShortURL)
+	assert.True(t, results[0].Created)
+}
+
+func TestModeration(t *testing.T) {
+	config := common.DefaultConfig()
+	config.AdminToken = "admin"
+	config.ModeratorToken = "moderator"
+	srv := newTestServer(t, config)
+	sa := srv.app
+
+	userID, err := sa.CreateUser(context.Background())
+	require.NoError(t, err)
+	_, err = sa.CreateShortURL(context.Background(), "https://spam.example.com/offer", "", time.Time{}, userID)
+	require.NoError(t, err)
+	_, err = sa.CreateShortURL(context.Background(), "https://example.org", "", time.Time{}, userID)
+	require.NoError(t, err)
+
+	// Moderator can't manage API keys
+	resp, _ := testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/keys",
+		[]byte(fmt.Sprintf(`{"user_id":%d}`, userID)), bearer("moderator"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=spam", nil, bearer("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=", nil, bearer("moderator"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var links []storage.Link
+	resp, body := testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=SPAM", nil, bearer("moderator"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &links))
+	require.Len(t, links, 1)
+	assert.Equal(t, storage.Link{ShortURL: "http://localhost/code0", OrigURL: "https://spam.example.com/offer"}, links[0])
+	resp, body = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=code", nil, bearer("admin"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &links))
+	assert.Len(t, links, 2)
+
+	// Either all short URLs are changed or none of them
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/urls/delete",
+		[]byte(`["code0","unknown"]`), bearer("moderator"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_, err = sa.GetOrigURL(context.Background(), "code0")
+	require.NoError(t, err)
+
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/urls/delete",
+		[]byte(`["http://localhost/code0"]`), bearer("moderator"))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = sa.GetOrigURL(context.Background(), "code0")
+	assert.ErrorIs(t, err, app.ErrURLDeleted)
+
+	resp, body = testRequest(t, srv.Server, http.MethodGet, "application/json", fmt.Sprintf("/api/admin/users/%d/urls", userID), nil, bearer("moderator"))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.Unmarshal([]byte(body), &links))
+	require.Len(t, links, 2)
+	for _, link := range links {
+		assert.Equal(t, link.ShortURL == "http://localhost/code0", link.Deleted)
+	}
+	resp, _ = testRequest(t, srv.Server, http.MethodGet, "application/json", fmt.Sprintf("/api/admin/users/%d/urls", userID+1), nil, bearer("moderator"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/urls/restore",
+		[]byte(`["code0"]`), bearer("admin"))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = sa.GetOrigURL(context.Background(), "code0")
+	assert.NoError(t, err)
+
+	// Expired short URL stays deleted
+	require.NoError(t, srv.storage.AddItem(context.Background(), "https://expired.example", "expired", time.Now().Add(-time.Hour), userID))
+	_, err = sa.MarkDeleteExpiredURLs(context.Background())
+	require.NoError(t, err)
+	resp, _ = testRequest(t, srv.Server, http.MethodPost, "application/json", "/api/admin/urls/restore",
+		[]byte(`["expired"]`), bearer("admin"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// lockedBuffer collects log output, which is written by handlers of test server
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns lines, which contain prefix, starting from prefix
+func (b *lockedBuffer) lines(prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []string
+	for _, line := range strings.Split(b.buf.String(), "\n") {
+		if i := strings.Index(line, prefix); i >= 0 {
+			lines = append(lines, line[i:])
+		}
+	}
+	return lines
+}
+
+func TestAdminAuditLog(t *testing.T) {
+	config := common.DefaultConfig()
+	config.AdminToken = "admin"
+	config.ModeratorToken = "moderator"
+	srv := newTestServer(t, config)
+
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	resp, _ := testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=spam", nil, bearer("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodDelete, "application/json", "/api/admin/keys/unknown", nil, bearer("moderator"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodDelete, "application/json", "/api/admin/keys/unknown", nil, bearer("admin"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = testRequest(t, srv.Server, http.MethodGet, "application/json", "/api/admin/urls?q=spam", nil, bearer("moderator"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Every request is logged once with its status, denied requests too
+	assert.Equal(t, []string{
+		"Admin request. Role:|Method:GET|Path:/api/admin/urls|Status:401",
+		"Admin request. Role:moderator|Method:DELETE|Path:/api/admin/keys/unknown|Status:403",
+		"Admin request. Role:admin|Method:DELETE|Path:/api/admin/keys/unknown|Status:404|Action:revoke_api_key|Key ID:unknown",
+		"Admin request. Role:moderator|Method:GET|Path:/api/admin/urls|Status:200|Action:search_urls|Query:spam|Found:0",
+	}, logs.lines("Admin "))
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"log"
+	"sync"
+	"time"
+)
+
+// Defaults of ClickRecorder
+const (
+	defaultClickBufferSize    = 1024
+	defaultClickBatchSize     = 100
+	defaultClickFlushInterval = time.Second
+	clickStoreTimeout         = 5 * time.Second
+)
+
+// Click events are kept for clickEventRetention, then they are rolled up into daily counters,
+// so storage doesn't grow with every redirect. Both kinds of storage apply the same retention
+const (
+	clickEventRetention = 30 * 24 * time.Hour
+	clickRollUpInterval = time.Hour
+)
+
+// ClickRecorder collects click events in buffer and stores them in batches in background,
+// so redirects don't wait for storage. If buffer is full, events are dropped
+type ClickRecorder struct {
+	storage       storage.Repository
+	events        chan storage.ClickEvent
+	batchSize     int
+	flushInterval time.Duration
+	closeOnce     sync.Once
+	done          chan struct{}
+	// mu guards closed, so Record doesn't send into closed channel of events
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewClickRecorder creates recorder and starts its background worker
+func NewClickRecorder(repo storage.Repository, bufferSize int) *ClickRecorder {
+	if bufferSize <= 0 {
+		bufferSize = defaultClickBufferSize
+	}
+	cr := &ClickRecorder{
+		storage:       repo,
+		events:        make(chan storage.ClickEvent, bufferSize),
+		batchSize:     defaultClickBatchSize,
+		flushInterval: defaultClickFlushInterval,
+		done:          make(chan struct{}),
+	}
+	go cr.run()
+	return cr
+}
+
+// Record puts event into buffer without blocking. Events recorded after Close are dropped
+func (cr *ClickRecorder) Record(event storage.ClickEvent) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	if cr.closed {
+		log.Printf("Click recorder is closed, click is dropped. Short URL:%s\n", event.ShortURL)
+		return
+	}
+	select {
+	case cr.events <- event:
+	default:
+		log.Printf("Click buffer is full, click is dropped. Short URL:%s\n", event.ShortURL)
+	}
+}
+
+// Close stores buffered events and stops worker
+func (cr *ClickRecorder) Close() {
+	cr.closeOnce.Do(func() {
+		cr.mu.Lock()
+		cr.closed = true
+		close(cr.events)
+		cr.mu.Unlock()
+		<-cr.done
+	})
+}
+
+func (cr *ClickRecorder) run() {
+	defer close(cr.done)
+	ticker := time.NewTicker(cr.flushInterval)
+	defer ticker.Stop()
+	rollUpTicker := time.NewTicker(clickRollUpInterval)
+	defer rollUpTicker.Stop()
+	cr.rollUp()
+	batch := make([]storage.ClickEvent, 0, cr.batchSize)
+	for {
+		select {
+		case event, ok := <-cr.events:
+			if !ok {
+				cr.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= cr.batchSize {
+				cr.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			cr.flush(batch)
+			batch = batch[:0]
+		case <-rollUpTicker.C:
+			cr.rollUp()
+		}
+	}
+}
+
+func (cr *ClickRecorder) flush(batch []storage.ClickEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), clickStoreTimeout)
+	defer cancelFunc()
+	if err := cr.storage.AddClicks(ctx, batch); err != nil {
+		log.Printf("Cannot store clicks. Number of clicks:%d|Error message:%s\n", len(batch), err.Error())
+	}
+}
+
+// rollUp replaces click events older than retention period with daily counters
+func (cr *ClickRecorder) rollUp() {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), clickStoreTimeout)
+	defer cancelFunc()
+	if err := cr.storage.RollUpClicks(ctx, time.Now().Add(-clickEventRetention)); err != nil {
+		log.Printf("Cannot roll up clicks. Error message:%s\n", err.Error())
+	}
+}
@@ -0,0 +1,219 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File of domain policy contains one rule per line in form "<allow|deny> <exact|suffix|regex> <pattern>".
+// Empty lines and lines started with # are ignored. Deny rules have priority over allow rules.
+// If there is at least one allow rule, only domains matched by allow rules are permitted.
+// Hosts are compared in ASCII form, so Unicode patterns are converted to punycode as hosts of stored URLs are.
+// Regex rules are matched against ASCII form of host and ignore case.
+
+var ErrDomainBlocked = errors.New("app: domain is blocked")
+
+// Kinds of domain rules
+const (
+	DomainRuleExact  = "exact"
+	DomainRuleSuffix = "suffix"
+	DomainRuleRegex  = "regex"
+)
+
+type domainRule struct {
+	kind    string
+	pattern string
+	re      *regexp.Regexp
+}
+
+func (r domainRule) match(host string) bool {
+	switch r.kind {
+	case DomainRuleExact:
+		return host == r.pattern
+	case DomainRuleSuffix:
+		return host == r.pattern || strings.HasSuffix(host, "."+r.pattern)
+	case DomainRuleRegex:
+		return r.re.MatchString(host)
+	}
+	return false
+}
+
+// DomainPolicy decides which destination domains may be shortened and redirected to
+type DomainPolicy struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	allow   []domainRule
+	deny    []domainRule
+}
+
+// NewDomainPolicy loads domain policy from file
+func NewDomainPolicy(path string) (*DomainPolicy, error) {
+	p := &DomainPolicy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads rules from file again. If file is invalid, previous rules are kept
+func (p *DomainPolicy) Reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	allow, deny, err := loadDomainRules(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow = allow
+	p.deny = deny
+	p.modTime = info.ModTime()
+	log.Printf("Domain policy loaded. Path:%s|Allow rules:%d|Deny rules:%d\n", p.path, len(allow), len(deny))
+	return nil
+}
+
+// Watch reloads policy when its file is changed or a signal is received from reload channel.
+// File is checked with given interval. Watch returns when ctx is done
+func (p *DomainPolicy) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			if err := p.Reload(); err != nil {
+				log.Printf("Cannot reload domain policy. Error message:%s\n", err.Error())
+			}
+		case <-ticker.C:
+			if !p.changed() {
+				continue
+			}
+			if err := p.Reload(); err != nil {
+				log.Printf("Cannot reload domain policy. Error message:%s\n", err.Error())
+			}
+		}
+	}
+}
+
+func (p *DomainPolicy) changed() bool {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !info.ModTime().Equal(p.modTime)
+}
+
+// Check returns ErrDomainBlocked if domain of URL is not permitted by policy
+func (p *DomainPolicy) Check(rawURL string) error {
+	host := hostOf(rawURL)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.deny {
+		if rule.match(host) {
+			return fmt.Errorf("%w: %s", ErrDomainBlocked, host)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.allow {
+		if rule.match(host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrDomainBlocked, host)
+}
+
+// hostOf returns lowercased ASCII host of URL. URLs without scheme or with Unicode hosts may be stored
+// by previous versions of service
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		u, err = url.Parse("http://" + rawURL)
+		if err != nil {
+			return ""
+		}
+	}
+	return normalizeHost(u.Hostname())
+}
+
+// normalizeHost converts host to lowercased ASCII form as NormalizeURL does. Hosts, which can't be converted,
+// are only lowercased
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+func loadDomainRules(path string) ([]domainRule, []domainRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var allow, deny []domainRule
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("domain policy line %d: expected \"<allow|deny> <kind> <pattern>\"", lineNum)
+		}
+		rule := domainRule{kind: fields[1], pattern: fields[2]}
+		switch rule.kind {
+		case DomainRuleExact, DomainRuleSuffix:
+			pattern := strings.TrimPrefix(strings.ToLower(rule.pattern), ".")
+			rule.pattern, err = idna.Lookup.ToASCII(strings.TrimSuffix(pattern, "."))
+			if err != nil {
+				return nil, nil, fmt.Errorf("domain policy line %d: invalid domain %s: %w", lineNum, fields[2], err)
+			}
+		case DomainRuleRegex:
+			rule.re, err = regexp.Compile("(?i)" + fields[2])
+			if err != nil {
+				return nil, nil, fmt.Errorf("domain policy line %d: %w", lineNum, err)
+			}
+		default:
+			return nil, nil, fmt.Errorf("domain policy line %d: unknown rule kind %s", lineNum, rule.kind)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, rule)
+		case "deny":
+			deny = append(deny, rule)
+		default:
+			return nil, nil, fmt.Errorf("domain policy line %d: unknown action %s", lineNum, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
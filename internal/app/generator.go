@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+const base62Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+const (
+	GeneratorHash    = "hash"
+	GeneratorCounter = "counter"
+	GeneratorRandom  = "random"
+)
+
+const defaultRandomCodeLength = 8
+
+// counterReserveSize is the number of values of counter reserved in storage at once. Values which were
+// reserved but not used before restart are skipped
+const counterReserveSize = 100
+
+var ErrUnknownGenerator = errors.New("app: unknown short code generator")
+
+// defaultGenerator is used when ShortenerApp has no generator set
+var defaultGenerator ShortCodeGenerator = &hashGenerator{}
+
+// ShortCodeGenerator makes short codes for original URLs. Attempt is the number of
+// previous collisions for this URL, so generator must return different code for each attempt
+type ShortCodeGenerator interface {
+	Generate(url string, attempt int) (string, error)
+}
+
+// CounterStore persists counter of counter generator, so codes are not reused after restart
+type CounterStore interface {
+	ReserveCounterRange(ctx context.Context, size uint64) (uint64, error)
+}
+
+// NewShortCodeGenerator returns generator by its name from config. Counter generator keeps its counter in store
+func NewShortCodeGenerator(kind string, salt string, store CounterStore) (ShortCodeGenerator, error) {
+	switch kind {
+	case "", GeneratorHash:
+		return &hashGenerator{salt: salt}, nil
+	case GeneratorCounter:
+		return &counterGenerator{store: store}, nil
+	case GeneratorRandom:
+		return &randomGenerator{length: defaultRandomCodeLength}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownGenerator, kind)
+}
+
+// hashGenerator makes code from checksum of salted URL. Without salt and collisions
+// codes are the same as ones made by previous versions of service
+type hashGenerator struct {
+	salt string
+}
+
+func (g *hashGenerator) Generate(url string, attempt int) (string, error) {
+	src := g.salt + url
+	if attempt > 0 {
+		src = fmt.Sprintf("%s#%d", src, attempt)
+	}
+	crc := crc32.ChecksumIEEE([]byte(src))
+	return fmt.Sprint(crc), nil
+}
+
+// counterGenerator makes sequential base62 codes. Values of counter are reserved in store by ranges,
+// so after restart generator continues after the last reserved range
+type counterGenerator struct {
+	mu    sync.Mutex
+	store CounterStore
+	// next is the next value of counter, limit is the end of reserved range
+	next  uint64
+	limit uint64
+}
+
+// Generate skips values, whose codes are reserved aliases, because such short URLs clash with routes of service
+func (g *counterGenerator) Generate(url string, attempt int) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for {
+		if g.next >= g.limit {
+			first, err := g.store.ReserveCounterRange(context.Background(), counterReserveSize)
+			if err != nil {
+				return "", err
+			}
+			g.next, g.limit = first, first+counterReserveSize
+		}
+		code := encodeBase62(g.next)
+		g.next++
+		if !reservedAliases[strings.ToLower(code)] {
+			return code, nil
+		}
+	}
+}
+
+// randomGenerator makes random base62 codes of fixed length
+type randomGenerator struct {
+	length int
+}
+
+func (g *randomGenerator) Generate(url string, attempt int) (string, error) {
+	var sb strings.Builder
+	max := big.NewInt(int64(len(base62Alphabet)))
+	for i := 0; i < g.length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(base62Alphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+func encodeBase62(n uint64) string {
+	if n == 0 {
+		return string(base62Alphabet[0])
+	}
+	var buf []byte
+	for n > 0 {
+		buf = append(buf, base62Alphabet[n%62])
+		n /= 62
+	}
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf)
+}
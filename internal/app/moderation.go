@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"strings"
+	"time"
+)
+
+// Limits of number of links returned by search
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+var ErrInvalidModeration = errors.New("app: invalid moderation request")
+
+// SearchURLs returns links, whose original or short URL contains query. limit 0 means default limit
+func (sa *ShortenerApp) SearchURLs(ctx context.Context, query string, limit int) ([]storage.Link, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("%w: query is empty", ErrInvalidModeration)
+	}
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if limit < 0 || limit > maxSearchLimit {
+		return nil, fmt.Errorf("%w: limit must be from 1 to %d", ErrInvalidModeration, maxSearchLimit)
+	}
+	links, err := sa.Storage.SearchItems(ctx, strings.TrimPrefix(query, sa.BaseAddress+"/"), limit)
+	if err != nil {
+		return nil, err
+	}
+	return sa.fullLinks(links), nil
+}
+
+// SetURLsDeleted marks short URLs as deleted or restores them regardless of their owners.
+// Short URLs may be given with base address. Either all short URLs exist or none of them is changed.
+// Expired short URLs can't be restored, because they would be deleted again by sweeper of expired URLs
+func (sa *ShortenerApp) SetURLsDeleted(ctx context.Context, shortURLs []string, deleted bool) error {
+	unique := make([]string, 0, len(shortURLs))
+	seen := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		shortURL = strings.TrimPrefix(shortURL, sa.BaseAddress+"/")
+		if !seen[shortURL] {
+			seen[shortURL] = true
+			unique = append(unique, shortURL)
+		}
+	}
+	if len(unique) == 0 {
+		return fmt.Errorf("%w: list of short URLs is empty", ErrInvalidModeration)
+	}
+	now := time.Now()
+	for _, shortURL := range unique {
+		item, err := sa.Storage.GetItem(ctx, shortURL)
+		if err != nil {
+			if errors.Is(err, storage.ErrEmptyResult) {
+				return fmt.Errorf("%w: %s", ErrCantFindURL, shortURL)
+			}
+			return err
+		}
+		if !deleted && !item.ExpiresAt.IsZero() && !item.ExpiresAt.After(now) {
+			return fmt.Errorf("%w: %s is expired and can't be restored", ErrInvalidModeration, shortURL)
+		}
+	}
+	if deleted {
+		return sa.Storage.MarkDeleteBatchItems(ctx, unique)
+	}
+	return sa.Storage.RestoreBatchItems(ctx, unique)
+}
+
+// GetUserLinks returns links from history of user with their moderation state
+func (sa *ShortenerApp) GetUserLinks(ctx context.Context, userID int64) ([]storage.Link, error) {
+	exists, err := sa.userExists(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrCantFindUser
+	}
+	links, err := sa.Storage.GetUserLinks(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return []storage.Link{}, nil
+		}
+		return nil, err
+	}
+	return sa.fullLinks(links), nil
+}
+
+// fullLinks adds base address to short URLs of links
+func (sa *ShortenerApp) fullLinks(links []storage.Link) []storage.Link {
+	for i := 0; i < len(links); i++ {
+		links[i].ShortURL = fmt.Sprintf("%s/%s", sa.BaseAddress, links[i].ShortURL)
+	}
+	if links == nil {
+		return []storage.Link{}
+	}
+	return links
+}
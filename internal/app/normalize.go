@@ -0,0 +1,131 @@
+package app
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Codes of URL validation errors
+const (
+	URLErrEmpty           = "empty"
+	URLErrTooLong         = "too_long"
+	URLErrMalformed       = "malformed"
+	URLErrMissingScheme   = "missing_scheme"
+	URLErrForbiddenScheme = "forbidden_scheme"
+	URLErrInvalidHost     = "invalid_host"
+)
+
+const defaultMaxURLLength = 2048
+
+// hostPortPattern matches URLs without scheme like "localhost:8080/path",
+// which url.Parse treats as URLs with scheme "localhost"
+var hostPortPattern = regexp.MustCompile(`^[^:/?#]+:\d+([/?#]|$)`)
+
+// URLPolicy configures validation and normalization of URLs before shortening
+type URLPolicy struct {
+	AllowedSchemes []string
+	// DefaultScheme is added to URLs without scheme. If it is empty, such URLs are rejected
+	DefaultScheme    string
+	StripDefaultPort bool
+	StripFragment    bool
+	MaxLength        int
+}
+
+// URLValidationError describes why URL was rejected
+type URLValidationError struct {
+	Code   string
+	Reason string
+}
+
+func (e *URLValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidURL.Error(), e.Reason)
+}
+
+func (e *URLValidationError) Unwrap() error {
+	return ErrInvalidURL
+}
+
+// DefaultURLPolicy returns policy, which accepts only http and https URLs with explicit scheme
+func DefaultURLPolicy() *URLPolicy {
+	return &URLPolicy{
+		AllowedSchemes:   []string{"http", "https"},
+		DefaultScheme:    "",
+		StripDefaultPort: true,
+		StripFragment:    false,
+		MaxLength:        defaultMaxURLLength,
+	}
+}
+
+// Normalize validates URL and returns it in canonical form: scheme and host are lowercased,
+// international host is converted to punycode, default port and fragment are stripped if policy says so
+func (p *URLPolicy) Normalize(rawURL string) (string, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return "", &URLValidationError{URLErrEmpty, "URL is empty"}
+	}
+	if p.MaxLength > 0 && len(rawURL) > p.MaxLength {
+		return "", &URLValidationError{URLErrTooLong, fmt.Sprintf("URL is longer than %d symbols", p.MaxLength)}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", &URLValidationError{URLErrMalformed, "URL cannot be parsed"}
+	}
+	if u.Scheme == "" || hostPortPattern.MatchString(rawURL) {
+		if p.DefaultScheme == "" {
+			return "", &URLValidationError{URLErrMissingScheme, "URL has no scheme"}
+		}
+		u, err = url.Parse(p.DefaultScheme + "://" + rawURL)
+		if err != nil {
+			return "", &URLValidationError{URLErrMalformed, "URL cannot be parsed"}
+		}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !p.schemeAllowed(u.Scheme) {
+		return "", &URLValidationError{URLErrForbiddenScheme, fmt.Sprintf("scheme %s is not allowed", u.Scheme)}
+	}
+
+	hostname := u.Hostname()
+	if hostname == "" {
+		return "", &URLValidationError{URLErrInvalidHost, "URL has no host"}
+	}
+	if ip := net.ParseIP(hostname); ip == nil {
+		hostname, err = idna.Lookup.ToASCII(hostname)
+		if err != nil {
+			return "", &URLValidationError{URLErrInvalidHost, fmt.Sprintf("invalid host %s", u.Hostname())}
+		}
+	}
+	port := u.Port()
+	if p.StripDefaultPort && (u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(hostname, ":") {
+		hostname = "[" + hostname + "]"
+	}
+	u.Host = hostname
+	if port != "" {
+		u.Host = hostname + ":" + port
+	}
+	if p.StripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	normalized := u.String()
+	if p.MaxLength > 0 && len(normalized) > p.MaxLength {
+		return "", &URLValidationError{URLErrTooLong, fmt.Sprintf("URL is longer than %d symbols", p.MaxLength)}
+	}
+	return normalized, nil
+}
+
+func (p *URLPolicy) schemeAllowed(scheme string) bool {
+	for _, allowed := range p.AllowedSchemes {
+		if strings.EqualFold(allowed, scheme) {
+			return true
+		}
+	}
+	return false
+}
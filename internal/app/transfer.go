@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+)
+
+var ErrInvalidTransfer = errors.New("app: invalid transfer")
+
+// TransferTarget is the new owner of short URLs. Exactly one of fields must be set.
+// If APIKeyID is set, short URLs are transferred to user, to whom API key was issued
+type TransferTarget struct {
+	UserID   int64
+	APIKeyID string
+}
+
+// TransferURLs transfers short URLs from history of owner to history of target user. Either all short URLs
+// are transferred or none of them. ErrCantFindURL is returned if some short URL doesn't belong to owner
+func (sa *ShortenerApp) TransferURLs(ctx context.Context, ownerID int64, shortURLs []string, target TransferTarget) error {
+	toUserID, err := sa.resolveTransferTarget(ctx, target)
+	if err != nil {
+		return err
+	}
+	if toUserID == ownerID {
+		return fmt.Errorf("%w: short URLs already belong to user", ErrInvalidTransfer)
+	}
+	unique := make([]string, 0, len(shortURLs))
+	seen := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		if !seen[shortURL] {
+			seen[shortURL] = true
+			unique = append(unique, shortURL)
+		}
+	}
+	if len(unique) == 0 {
+		return fmt.Errorf("%w: list of short URLs is empty", ErrInvalidTransfer)
+	}
+	if err := sa.Storage.TransferItems(ctx, unique, ownerID, toUserID); err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return ErrCantFindURL
+		}
+		return err
+	}
+	return nil
+}
+
+// resolveTransferTarget returns ID of user, who receives short URLs. ErrCantFindUser is returned for unknown users
+// as well as for unknown and revoked API keys, so all targets, which can't receive short URLs, look the same
+func (sa *ShortenerApp) resolveTransferTarget(ctx context.Context, target TransferTarget) (int64, error) {
+	if (target.UserID == 0) == (target.APIKeyID == "") {
+		return 0, fmt.Errorf("%w: exactly one of user ID and API key ID must be set", ErrInvalidTransfer)
+	}
+	if target.APIKeyID != "" {
+		key, err := sa.Storage.GetAPIKey(ctx, target.APIKeyID)
+		if err != nil {
+			if errors.Is(err, storage.ErrEmptyResult) {
+				return 0, ErrCantFindUser
+			}
+			return 0, err
+		}
+		if !key.RevokedAt.IsZero() {
+			return 0, ErrCantFindUser
+		}
+		return key.UserID, nil
+	}
+	exists, err := sa.userExists(ctx, target.UserID)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, ErrCantFindUser
+	}
+	return target.UserID, nil
+}
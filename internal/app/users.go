@@ -0,0 +1,51 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"time"
+)
+
+// lastSeenGranularity limits how often last-seen time of user is written to storage
+const lastSeenGranularity = time.Minute
+
+var ErrCantFindUser = errors.New("app: cannot find user")
+
+// CreateUser registers new user and returns its ID
+func (sa *ShortenerApp) CreateUser(ctx context.Context) (int64, error) {
+	return sa.Storage.CreateUser(ctx, time.Now())
+}
+
+// TouchUser confirms that user presented by token exists and records last-seen time of user.
+// Token issued before user was registered belongs to user with the same ID from lost registry,
+// ErrCantFindUser is returned for it as well as for unknown users
+func (sa *ShortenerApp) TouchUser(ctx context.Context, userID int64, tokenIssuedAt time.Time) error {
+	user, err := sa.Storage.GetUser(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return ErrCantFindUser
+		}
+		return err
+	}
+	if tokenIssuedAt.Before(user.CreatedAt.Truncate(time.Second)) {
+		return ErrCantFindUser
+	}
+	now := time.Now()
+	if now.Sub(user.LastSeenAt) < lastSeenGranularity {
+		return nil
+	}
+	return sa.Storage.TouchUser(ctx, userID, now)
+}
+
+// userExists checks that user is registered
+func (sa *ShortenerApp) userExists(ctx context.Context, userID int64) (bool, error) {
+	_, err := sa.Storage.GetUser(ctx, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,231 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"strings"
+	"time"
+)
+
+// Roles of workspace members. Viewers see links of workspace, editors also add and delete them,
+// owners also manage members
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// maxWorkspaceNameLength is the limit of length of workspace name in symbols
+const maxWorkspaceNameLength = 128
+
+var ErrCantFindWorkspace = errors.New("app: cannot find workspace")
+var ErrWorkspaceForbidden = errors.New("app: not enough rights in workspace")
+var ErrInvalidWorkspace = errors.New("app: invalid workspace request")
+
+// ErrNotAddedToWorkspace is returned with short URL, which is created, but can't be added to workspace
+var ErrNotAddedToWorkspace = errors.New("app: short URL is created, but not added to workspace")
+
+// roleRanks orders roles by rights. Role with greater rank has all rights of roles with smaller rank
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// CreateWorkspace creates workspace, where user is owner
+func (sa *ShortenerApp) CreateWorkspace(ctx context.Context, userID int64, name string) (*storage.Workspace, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len([]rune(name)) > maxWorkspaceNameLength {
+		return nil, fmt.Errorf("%w: name must be from 1 to %d symbols", ErrInvalidWorkspace, maxWorkspaceNameLength)
+	}
+	return sa.Storage.CreateWorkspace(ctx, name, userID, RoleOwner, time.Now())
+}
+
+func (sa *ShortenerApp) GetUserWorkspaces(ctx context.Context, userID int64) ([]storage.WorkspaceMembership, error) {
+	return sa.Storage.GetUserWorkspaces(ctx, userID)
+}
+
+// GetWorkspaceMembers returns members of workspace. Members are visible to members only
+func (sa *ShortenerApp) GetWorkspaceMembers(ctx context.Context, userID int64, workspaceID int64) ([]storage.WorkspaceMember, error) {
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, RoleViewer); err != nil {
+		return nil, err
+	}
+	return sa.Storage.GetWorkspaceMembers(ctx, workspaceID)
+}
+
+// SetWorkspaceMember adds user to workspace or changes role of member. Only owners can do it,
+// and the last owner can't give up ownership
+func (sa *ShortenerApp) SetWorkspaceMember(ctx context.Context, userID int64, workspaceID int64, memberID int64, role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return fmt.Errorf("%w: unknown role %s", ErrInvalidWorkspace, role)
+	}
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, RoleOwner); err != nil {
+		return err
+	}
+	exists, err := sa.userExists(ctx, memberID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrCantFindUser
+	}
+	return workspaceMemberError(sa.Storage.SetWorkspaceMember(ctx, workspaceID, memberID, role, RoleOwner))
+}
+
+// RemoveWorkspaceMember removes member from workspace. Owners can remove anybody, other members only themselves
+func (sa *ShortenerApp) RemoveWorkspaceMember(ctx context.Context, userID int64, workspaceID int64, memberID int64) error {
+	requiredRole := RoleOwner
+	if userID == memberID {
+		requiredRole = RoleViewer
+	}
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, requiredRole); err != nil {
+		return err
+	}
+	err := sa.Storage.RemoveWorkspaceMember(ctx, workspaceID, memberID, RoleOwner)
+	if errors.Is(err, storage.ErrEmptyResult) {
+		return ErrCantFindUser
+	}
+	return workspaceMemberError(err)
+}
+
+// CreateWorkspaceShortURL creates short URL as CreateShortURL does and adds it to workspace.
+// User must be at least editor of workspace. If URL was shortened before by user, existing short URL is added
+// to workspace and error of CreateShortURL is returned, so caller reports existing short URL as usual.
+// If new short URL can't be added to workspace, it is returned with ErrNotAddedToWorkspace
+func (sa *ShortenerApp) CreateWorkspaceShortURL(ctx context.Context, url string, alias string, expiresAt time.Time, userID int64, workspaceID int64) (string, error) {
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, RoleEditor); err != nil {
+		return "", err
+	}
+	fullShortURL, err := sa.CreateShortURL(ctx, url, alias, expiresAt, userID)
+	if errors.Is(err, storage.ErrAlreadyExist) || errors.Is(err, ErrAliasURLExists) {
+		existing, errExist := sa.GetExistShortURL(ctx, url)
+		if errExist != nil {
+			return "", errExist
+		}
+		if errAdd := sa.addExistingToWorkspace(ctx, userID, workspaceID, existing); errAdd != nil {
+			return "", errAdd
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	shortURL := strings.TrimPrefix(fullShortURL, sa.BaseAddress+"/")
+	if err := sa.Storage.AddWorkspaceItems(ctx, workspaceID, []string{shortURL}); err != nil {
+		return fullShortURL, fmt.Errorf("%w: %s", ErrNotAddedToWorkspace, err.Error())
+	}
+	return fullShortURL, nil
+}
+
+// CreateWorkspaceShortURLs creates short URLs as CreateShortURLs does and adds them to workspace. URLs shortened
+// before by other users are not added, error is set in their results. Created short URLs, which can't be added
+// to workspace, keep their results with ErrNotAddedToWorkspace
+func (sa *ShortenerApp) CreateWorkspaceShortURLs(ctx context.Context, urls []string, expiresAt []time.Time, userID int64, workspaceID int64) ([]ShortURLResult, error) {
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, RoleEditor); err != nil {
+		return nil, err
+	}
+	results := sa.CreateShortURLs(ctx, urls, expiresAt, userID)
+	var shortURLs []string
+	var added []int
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		if !result.Created {
+			if err := sa.addExistingToWorkspace(ctx, userID, workspaceID, result.ShortURL); err != nil {
+				results[i].Err = err
+			}
+			continue
+		}
+		shortURLs = append(shortURLs, strings.TrimPrefix(result.ShortURL, sa.BaseAddress+"/"))
+		added = append(added, i)
+	}
+	if len(shortURLs) == 0 {
+		return results, nil
+	}
+	if err := sa.Storage.AddWorkspaceItems(ctx, workspaceID, shortURLs); err != nil {
+		for _, i := range added {
+			results[i].Err = fmt.Errorf("%w: %s", ErrNotAddedToWorkspace, err.Error())
+		}
+	}
+	return results, nil
+}
+
+// GetHistoryURLsForWorkspace returns links of workspace in the same format as GetHistoryURLsForUser.
+// storage.ErrEmptyResult is returned if workspace has no links
+func (sa *ShortenerApp) GetHistoryURLsForWorkspace(ctx context.Context, userID int64, workspaceID int64) ([]byte, error) {
+	if err := sa.CheckWorkspaceRole(ctx, userID, workspaceID, RoleViewer); err != nil {
+		return make([]byte, 0), err
+	}
+	history, err := sa.Storage.GetWorkspaceHistory(ctx, workspaceID)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	for i := 0; i < len(history); i++ {
+		history[i].ShortURL = fmt.Sprintf("%s/%s", sa.BaseAddress, history[i].ShortURL)
+	}
+	historyByJSON, err := json.Marshal(history)
+	if err != nil {
+		return make([]byte, 0), err
+	}
+	return historyByJSON, nil
+}
+
+// UserCanDeleteURL checks that short URL is in history of user or in workspace, where user is at least editor
+func (sa *ShortenerApp) UserCanDeleteURL(ctx context.Context, userID int64, shortURL string) (bool, error) {
+	owned, err := sa.UserHaveURLinHistory(ctx, userID, shortURL)
+	if err != nil || owned {
+		return owned, err
+	}
+	roles, err := sa.Storage.GetWorkspaceItemRoles(ctx, shortURL, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if roleRanks[role] >= roleRanks[RoleEditor] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// addExistingToWorkspace adds short URL created before to workspace. Only short URLs from history of user
+// are added, otherwise editors of workspace would be able to delete links of other users
+func (sa *ShortenerApp) addExistingToWorkspace(ctx context.Context, userID int64, workspaceID int64, fullShortURL string) error {
+	shortURL := strings.TrimPrefix(fullShortURL, sa.BaseAddress+"/")
+	owned, err := sa.UserHaveURLinHistory(ctx, userID, shortURL)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return fmt.Errorf("%w: URL is shortened by another user and can't be added to workspace", ErrWorkspaceForbidden)
+	}
+	return sa.Storage.AddWorkspaceItems(ctx, workspaceID, []string{shortURL})
+}
+
+// CheckWorkspaceRole checks that user has at least role minRole in workspace. ErrCantFindWorkspace is returned
+// if user is not member of workspace, so users can't find out which workspaces exist
+func (sa *ShortenerApp) CheckWorkspaceRole(ctx context.Context, userID int64, workspaceID int64, minRole string) error {
+	role, err := sa.Storage.GetWorkspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			return ErrCantFindWorkspace
+		}
+		return err
+	}
+	if roleRanks[role] < roleRanks[minRole] {
+		return fmt.Errorf("%w: role %s is required", ErrWorkspaceForbidden, minRole)
+	}
+	return nil
+}
+
+// workspaceMemberError converts error of change of workspace members. Workspace may be deleted
+// after check of rights, so storage doesn't find it
+func workspaceMemberError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrLastWorkspaceOwner):
+		return fmt.Errorf("%w: workspace must have at least one owner", ErrInvalidWorkspace)
+	case errors.Is(err, storage.ErrEmptyResult):
+		return ErrCantFindWorkspace
+	}
+	return err
+}
@@ -0,0 +1,352 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every setting may be set by flag, environment variable or key of config file. Flags have the highest priority,
+// then environment variables, then config file, then defaults. Config file is set by -c flag or CONFIG variable
+// and has JSON or YAML format depending on extension. Durations are written as "20m", "2s".
+
+const defaultServerAddress = ":8080"
+const defaultBaseAddress = "http://localhost:8080"
+const defaultHTTPSBaseAddress = "https://localhost:8080"
+const defaultShortCodeGenerator = "hash"
+const defaultURLMaxLength = 2048
+const defaultCookieTTL = 20 * time.Minute
+const defaultDeleteWorkerInterval = 2 * time.Second
+const defaultDatabaseQueryTimeout = 2 * time.Second
+
+var ErrInvalidConfig = errors.New("common: invalid config")
+
+type Config struct {
+	ServerAddress      string
+	BaseAddress        string
+	StoragePath        string
+	DatabasePath       string
+	ShortCodeGenerator string
+	ShortCodeSalt      string
+	// Settings of validation and normalization of URLs before shortening
+	URLDefaultScheme    string
+	URLStripFragment    bool
+	URLStripDefaultPort bool
+	URLMaxLength        int
+	// DomainPolicyPath is the path to file with allow and deny rules for destination domains
+	DomainPolicyPath string
+	// EnableHTTPS turns on TLS. If paths of certificate and key are empty, self-signed certificate is generated
+	EnableHTTPS bool
+	TLSCertPath string
+	TLSKeyPath  string
+	// SecretKey signs user cookies. PreviousSecretKeys is comma separated list of keys, which are still
+	// accepted in cookies. SecretKeyFile replaces both of them with keys written one per line, primary first
+	SecretKey          string
+	PreviousSecretKeys string
+	SecretKeyFile      string
+	CookieTTL          time.Duration
+	// DeleteWorkerInterval is the period of marking as deleted URLs collected from delete requests
+	DeleteWorkerInterval time.Duration
+	// AdminToken authenticates requests to admin API. ModeratorToken gives access only to moderation
+	// of links. Admin API is disabled if both of them are empty
+	AdminToken     string
+	ModeratorToken string
+	// DatabaseQueryTimeout limits duration of every database query
+	DatabaseQueryTimeout time.Duration
+}
+
+// DefaultConfig returns config with default values of all settings
+func DefaultConfig() *Config {
+	return &Config{
+		ServerAddress:        defaultServerAddress,
+		BaseAddress:          defaultBaseAddress,
+		ShortCodeGenerator:   defaultShortCodeGenerator,
+		URLStripDefaultPort:  true,
+		URLMaxLength:         defaultURLMaxLength,
+		CookieTTL:            defaultCookieTTL,
+		DeleteWorkerInterval: defaultDeleteWorkerInterval,
+		DatabaseQueryTimeout: defaultDatabaseQueryTimeout,
+	}
+}
+
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	usage  string
+	define func(fs *flag.FlagSet, c *Config)
+	set    func(c *Config, value string) error
+}
+
+func stringSetting(key, env, flagName, usage string, field func(c *Config) *string) setting {
+	return setting{key, env, flagName, usage,
+		func(fs *flag.FlagSet, c *Config) {
+			fs.StringVar(field(c), flagName, *field(c), usage)
+		},
+		func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		}}
+}
+
+func boolSetting(key, env, flagName, usage string, field func(c *Config) *bool) setting {
+	return setting{key, env, flagName, usage,
+		func(fs *flag.FlagSet, c *Config) {
+			fs.BoolVar(field(c), flagName, *field(c), usage)
+		},
+		func(c *Config, value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be boolean, got %q", ErrInvalidConfig, key, value)
+			}
+			*field(c) = parsed
+			return nil
+		}}
+}
+
+func intSetting(key, env, flagName, usage string, field func(c *Config) *int) setting {
+	return setting{key, env, flagName, usage,
+		func(fs *flag.FlagSet, c *Config) {
+			fs.IntVar(field(c), flagName, *field(c), usage)
+		},
+		func(c *Config, value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be integer, got %q", ErrInvalidConfig, key, value)
+			}
+			*field(c) = parsed
+			return nil
+		}}
+}
+
+func durationSetting(key, env, flagName, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{key, env, flagName, usage,
+		func(fs *flag.FlagSet, c *Config) {
+			fs.DurationVar(field(c), flagName, *field(c), usage)
+		},
+		func(c *Config, value string) error {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%w: %s must be duration, got %q", ErrInvalidConfig, key, value)
+			}
+			*field(c) = parsed
+			return nil
+		}}
+}
+
+var settings = []setting{
+	stringSetting("server_address", "SERVER_ADDRESS", "a", "Start server address.",
+		func(c *Config) *string { return &c.ServerAddress }),
+	stringSetting("base_url", "BASE_URL", "b", "Base address for short URLs",
+		func(c *Config) *string { return &c.BaseAddress }),
+	stringSetting("file_storage_path", "FILE_STORAGE_PATH", "f", "Path for storage of short URLs",
+		func(c *Config) *string { return &c.StoragePath }),
+	stringSetting("database_dsn", "DATABASE_DSN", "d", "Path for connect to database",
+		func(c *Config) *string { return &c.DatabasePath }),
+	durationSetting("database_query_timeout", "DATABASE_QUERY_TIMEOUT", "db-timeout", "Timeout of database queries",
+		func(c *Config) *time.Duration { return &c.DatabaseQueryTimeout }),
+	stringSetting("short_code_generator", "SHORT_CODE_GENERATOR", "g", "Generator of short URLs: hash, counter or random",
+		func(c *Config) *string { return &c.ShortCodeGenerator }),
+	stringSetting("short_code_salt", "SHORT_CODE_SALT", "salt", "Salt for hash generator of short URLs",
+		func(c *Config) *string { return &c.ShortCodeSalt }),
+	stringSetting("url_default_scheme", "URL_DEFAULT_SCHEME", "url-scheme",
+		"Scheme added to URLs without scheme. If empty, such URLs are rejected",
+		func(c *Config) *string { return &c.URLDefaultScheme }),
+	boolSetting("url_strip_fragment", "URL_STRIP_FRAGMENT", "url-strip-fragment", "Strip fragment from URLs",
+		func(c *Config) *bool { return &c.URLStripFragment }),
+	boolSetting("url_strip_default_port", "URL_STRIP_DEFAULT_PORT", "url-strip-port", "Strip default port from URLs",
+		func(c *Config) *bool { return &c.URLStripDefaultPort }),
+	intSetting("url_max_length", "URL_MAX_LENGTH", "url-max-length", "Max length of URL",
+		func(c *Config) *int { return &c.URLMaxLength }),
+	stringSetting("domain_policy_file", "DOMAIN_POLICY_FILE", "domain-policy",
+		"Path to file with allow and deny rules for destination domains",
+		func(c *Config) *string { return &c.DomainPolicyPath }),
+	boolSetting("enable_https", "ENABLE_HTTPS", "s", "Serve HTTPS",
+		func(c *Config) *bool { return &c.EnableHTTPS }),
+	stringSetting("tls_cert_file", "TLS_CERT_FILE", "tls-cert", "Path to PEM file with TLS certificate",
+		func(c *Config) *string { return &c.TLSCertPath }),
+	stringSetting("tls_key_file", "TLS_KEY_FILE", "tls-key", "Path to PEM file with TLS key",
+		func(c *Config) *string { return &c.TLSKeyPath }),
+	stringSetting("secret_key", "SECRET_KEY", "secret", "Secret key for signing of cookies",
+		func(c *Config) *string { return &c.SecretKey }),
+	stringSetting("previous_secret_keys", "PREVIOUS_SECRET_KEYS", "previous-secrets",
+		"Comma separated secret keys, which are still accepted in cookies",
+		func(c *Config) *string { return &c.PreviousSecretKeys }),
+	stringSetting("secret_key_file", "SECRET_KEY_FILE", "secret-file",
+		"Path to file with secret keys, one per line. First key is used for signing",
+		func(c *Config) *string { return &c.SecretKeyFile }),
+	durationSetting("cookie_ttl", "COOKIE_TTL", "cookie-ttl", "Lifetime of user cookies",
+		func(c *Config) *time.Duration { return &c.CookieTTL }),
+	durationSetting("delete_worker_interval", "DELETE_WORKER_INTERVAL", "delete-interval",
+		"Period of deleting of URLs collected from delete requests",
+		func(c *Config) *time.Duration { return &c.DeleteWorkerInterval }),
+	stringSetting("admin_token", "ADMIN_TOKEN", "admin-token",
+		"Bearer token of admin API. Admin API is disabled if token is not set",
+		func(c *Config) *string { return &c.AdminToken }),
+	stringSetting("moderator_token", "MODERATOR_TOKEN", "moderator-token",
+		"Bearer token of admin API, which gives access only to moderation of links",
+		func(c *Config) *string { return &c.ModeratorToken }),
+}
+
+// InitConfig reads settings from command line, environment and config file
+func InitConfig() (*Config, error) {
+	return LoadConfig(flag.CommandLine, os.Args[1:], os.LookupEnv)
+}
+
+// LoadConfig defines flags of settings in fs, parses args and merges them with environment and config file.
+// Settings are validated
+func LoadConfig(fs *flag.FlagSet, args []string, lookupEnv func(key string) (string, bool)) (*Config, error) {
+	conf, err := ParseConfig(fs, args, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// ParseConfig works like LoadConfig, but doesn't validate settings. It is used by subcommands,
+// which need only part of settings
+func ParseConfig(fs *flag.FlagSet, args []string, lookupEnv func(key string) (string, bool)) (*Config, error) {
+	var configPath string
+	fs.StringVar(&configPath, "c", "", "Path to JSON or YAML config file")
+	// Flags are bound to separate config, values of flags set explicitly are applied after file and environment
+	flagConf := DefaultConfig()
+	for _, s := range settings {
+		s.define(fs, flagConf)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	conf := DefaultConfig()
+	if !setFlags["c"] {
+		configPath, _ = lookupEnv("CONFIG")
+	}
+	if configPath != "" {
+		values, err := readConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := conf.apply(values); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		value, ok := lookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		if err := s.set(conf, value); err != nil {
+			return nil, fmt.Errorf("%w (environment variable %s)", err, s.env)
+		}
+	}
+	for _, s := range settings {
+		if !setFlags[s.flag] {
+			continue
+		}
+		if err := s.set(conf, fs.Lookup(s.flag).Value.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.EnableHTTPS && conf.BaseAddress == defaultBaseAddress {
+		conf.BaseAddress = defaultHTTPSBaseAddress
+	}
+	return conf, nil
+}
+
+// apply sets values from config file
+func (c *Config) apply(values map[string]string) error {
+	for key, value := range values {
+		found := false
+		for _, s := range settings {
+			if s.key != key {
+				continue
+			}
+			if err := s.set(c, value); err != nil {
+				return fmt.Errorf("%w (config file)", err)
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("%w: unknown key %s in config file", ErrInvalidConfig, key)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads flat JSON or YAML object. Values are converted to strings and parsed as values of flags
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read config file: %s", ErrInvalidConfig, err.Error())
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	default:
+		err = json.Unmarshal(content, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot parse config file %s: %s", ErrInvalidConfig, path, err.Error())
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		case int:
+			values[key] = strconv.Itoa(v)
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("%w: value of %s in config file must be string, number or boolean", ErrInvalidConfig, key)
+		}
+	}
+	return values, nil
+}
+
+// Validate checks values of settings
+func (c *Config) Validate() error {
+	if c.ServerAddress == "" {
+		return fmt.Errorf("%w: server address is empty", ErrInvalidConfig)
+	}
+	baseURL, err := url.Parse(c.BaseAddress)
+	if err != nil || baseURL.Host == "" {
+		return fmt.Errorf("%w: base address %q must be absolute URL", ErrInvalidConfig, c.BaseAddress)
+	}
+	if c.URLMaxLength <= 0 {
+		return fmt.Errorf("%w: max length of URL must be positive", ErrInvalidConfig)
+	}
+	if c.SecretKey == "" && c.PreviousSecretKeys != "" {
+		return fmt.Errorf("%w: previous secret keys are set without secret key", ErrInvalidConfig)
+	}
+	if c.CookieTTL <= 0 {
+		return fmt.Errorf("%w: cookie TTL must be positive", ErrInvalidConfig)
+	}
+	if c.DeleteWorkerInterval <= 0 {
+		return fmt.Errorf("%w: delete worker interval must be positive", ErrInvalidConfig)
+	}
+	if c.DatabaseQueryTimeout <= 0 {
+		return fmt.Errorf("%w: database query timeout must be positive", ErrInvalidConfig)
+	}
+	return c.ValidateTLS()
+}
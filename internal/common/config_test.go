@@ -0,0 +1,110 @@
+package common_test
+
+import (
+	"flag"
+	"github.com/ffrxp/go-practicum/internal/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func envFromMap(env map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func loadConfig(args []string, env map[string]string) (*common.Config, error) {
+	return common.LoadConfig(flag.NewFlagSet("shortener", flag.ContinueOnError), args, envFromMap(env))
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	conf, err := loadConfig(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, common.DefaultConfig(), conf)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(jsonPath, []byte(`{
+		"server_address": ":9090",
+		"base_url": "http://file.example",
+		"database_dsn": "postgres://file",
+		"url_max_length": 100,
+		"url_strip_default_port": false,
+		"cookie_ttl": "1h",
+		"delete_worker_interval": "5s",
+		"database_query_timeout": "10s"
+	}`), 0666))
+	yamlPath := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(yamlPath, []byte("server_address: \":7070\"\nsecret_key: yaml-secret\n"), 0666))
+
+	env := map[string]string{
+		"CONFIG":       jsonPath,
+		"BASE_URL":     "http://env.example",
+		"DATABASE_DSN": "postgres://env",
+		"COOKIE_TTL":   "30m",
+	}
+	conf, err := loadConfig([]string{"-d", "postgres://flag", "-url-max-length", "200"}, env)
+	require.NoError(t, err)
+	assert.Equal(t, ":9090", conf.ServerAddress)
+	assert.Equal(t, "http://env.example", conf.BaseAddress)
+	assert.Equal(t, "postgres://flag", conf.DatabasePath)
+	assert.Equal(t, 200, conf.URLMaxLength)
+	assert.False(t, conf.URLStripDefaultPort)
+	assert.Equal(t, 30*time.Minute, conf.CookieTTL)
+	assert.Equal(t, 5*time.Second, conf.DeleteWorkerInterval)
+	assert.Equal(t, 10*time.Second, conf.DatabaseQueryTimeout)
+
+	// -c flag has priority over CONFIG variable
+	conf, err = loadConfig([]string{"-c", yamlPath}, env)
+	require.NoError(t, err)
+	assert.Equal(t, ":7070", conf.ServerAddress)
+	assert.Equal(t, "yaml-secret", conf.SecretKey)
+	assert.Equal(t, "postgres://env", conf.DatabasePath)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknownKeyPath := filepath.Join(dir, "unknown.json")
+	require.NoError(t, os.WriteFile(unknownKeyPath, []byte(`{"server_adress": ":9090"}`), 0666))
+	nestedPath := filepath.Join(dir, "nested.yaml")
+	require.NoError(t, os.WriteFile(nestedPath, []byte("server_address:\n  host: localhost\n"), 0666))
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "missing file", args: []string{"-c", filepath.Join(dir, "missing.json")}},
+		{name: "unknown key", args: []string{"-c", unknownKeyPath}},
+		{name: "nested value", args: []string{"-c", nestedPath}},
+		{name: "invalid env", env: map[string]string{"URL_MAX_LENGTH": "long"}},
+		{name: "invalid duration", args: []string{"-cookie-ttl", "0s"}},
+		{name: "invalid query timeout", env: map[string]string{"DATABASE_QUERY_TIMEOUT": "0s"}},
+		{name: "relative base URL", args: []string{"-b", "localhost"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(tt.args, tt.env)
+			assert.ErrorIs(t, err, common.ErrInvalidConfig)
+		})
+	}
+}
+
+func TestParseConfigWithoutValidation(t *testing.T) {
+	args := []string{"-d", "postgres://localhost/db", "-tls-cert", "cert.pem", "migrate", "up"}
+	_, err := loadConfig(args, nil)
+	assert.ErrorIs(t, err, common.ErrInvalidTLSConfig)
+
+	fs := flag.NewFlagSet("shortener", flag.ContinueOnError)
+	conf, err := common.ParseConfig(fs, args, envFromMap(nil))
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://localhost/db", conf.DatabasePath)
+	assert.Equal(t, []string{"migrate", "up"}, fs.Args())
+}
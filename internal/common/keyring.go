@@ -0,0 +1,107 @@
+package common
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// randomSecretKeyLength is the length of key generated when no secret key is configured
+const randomSecretKeyLength = 32
+
+// Keyring keeps keys for signing of user cookies. New signatures are made with primary key,
+// previous keys are used only for verification, so keys may be rotated without logging out users
+type Keyring struct {
+	primary  []byte
+	previous [][]byte
+}
+
+// NewKeyring creates keyring from primary key and keys which are not retired yet
+func NewKeyring(primary []byte, previous ...[]byte) (*Keyring, error) {
+	if len(primary) == 0 {
+		return nil, fmt.Errorf("%w: primary secret key is empty", ErrInvalidConfig)
+	}
+	return &Keyring{primary: primary, previous: previous}, nil
+}
+
+// Sign signs message with primary key
+func (k *Keyring) Sign(msg []byte) []byte {
+	return SignMsg(msg, k.primary)
+}
+
+// Verify checks signature of message with all keys. outdated is true if message is signed with previous key
+func (k *Keyring) Verify(msg []byte, signature []byte) (ok bool, outdated bool) {
+	if hmac.Equal(signature, SignMsg(msg, k.primary)) {
+		return true, false
+	}
+	for _, key := range k.previous {
+		if hmac.Equal(signature, SignMsg(msg, key)) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// LoadKeyring makes keyring from settings. If file of keys is set, first key of file is primary and others are
+// previous. Otherwise secret key is primary and previous keys are taken from comma separated list.
+// If no key is configured, random key is generated, so cookies become invalid after restart
+func (c *Config) LoadKeyring() (*Keyring, error) {
+	var keys []string
+	if c.SecretKeyFile != "" {
+		fileKeys, err := readSecretKeyFile(c.SecretKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = fileKeys
+	} else if c.SecretKey != "" {
+		keys = append(keys, c.SecretKey)
+		for _, key := range strings.Split(c.PreviousSecretKeys, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		log.Printf("Secret key is not set, random key is generated. Cookies will be invalid after restart\n")
+		key := make([]byte, randomSecretKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		return NewKeyring(key)
+	}
+	previous := make([][]byte, 0, len(keys)-1)
+	for _, key := range keys[1:] {
+		previous = append(previous, []byte(key))
+	}
+	return NewKeyring([]byte(keys[0]), previous...)
+}
+
+// readSecretKeyFile reads keys written one per line. Empty lines and lines started with # are ignored
+func readSecretKeyFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read secret key file: %s", ErrInvalidConfig, err.Error())
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: secret key file %s has no keys", ErrInvalidConfig, path)
+	}
+	return keys, nil
+}
@@ -0,0 +1,61 @@
+package common_test
+
+import (
+	"github.com/ffrxp/go-practicum/internal/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	msg := []byte("token1")
+	oldKeyring, err := common.NewKeyring([]byte("old"))
+	require.NoError(t, err)
+	keyring, err := common.NewKeyring([]byte("new"), []byte("old"))
+	require.NoError(t, err)
+
+	ok, outdated := keyring.Verify(msg, keyring.Sign(msg))
+	assert.True(t, ok)
+	assert.False(t, outdated)
+	ok, outdated = keyring.Verify(msg, oldKeyring.Sign(msg))
+	assert.True(t, ok)
+	assert.True(t, outdated)
+	ok, _ = oldKeyring.Verify(msg, keyring.Sign(msg))
+	assert.False(t, ok)
+	ok, _ = keyring.Verify([]byte("token2"), keyring.Sign(msg))
+	assert.False(t, ok)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	msg := []byte("token1")
+	primary, err := common.NewKeyring([]byte("second"))
+	require.NoError(t, err)
+	previous, err := common.NewKeyring([]byte("first"))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte("# rotated monthly\nsecond\n\nfirst\n"), 0600))
+	for _, conf := range []common.Config{
+		{SecretKey: "second", PreviousSecretKeys: "first, "},
+		{SecretKeyFile: path},
+	} {
+		keyring, err := conf.LoadKeyring()
+		require.NoError(t, err)
+		assert.Equal(t, primary.Sign(msg), keyring.Sign(msg))
+		ok, outdated := keyring.Verify(msg, previous.Sign(msg))
+		assert.True(t, ok)
+		assert.True(t, outdated)
+	}
+
+	// Random keys are generated when nothing is configured
+	first, err := (&common.Config{}).LoadKeyring()
+	require.NoError(t, err)
+	second, err := (&common.Config{}).LoadKeyring()
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Sign(msg), second.Sign(msg))
+
+	_, err = (&common.Config{SecretKeyFile: filepath.Join(t.TempDir(), "missing")}).LoadKeyring()
+	assert.ErrorIs(t, err, common.ErrInvalidConfig)
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+)
+
+// selfSignedCertValidity is the lifetime of generated self-signed certificate
+const selfSignedCertValidity = 365 * 24 * time.Hour
+
+var ErrInvalidTLSConfig = errors.New("common: invalid TLS config")
+
+// ValidateTLS checks that paths of certificate and key are set together and scheme of base address
+// corresponds to mode of server
+func (c *Config) ValidateTLS() error {
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		return fmt.Errorf("%w: certificate and key must be set together", ErrInvalidTLSConfig)
+	}
+	if !c.EnableHTTPS && c.TLSCertPath != "" {
+		return fmt.Errorf("%w: certificate is set, but HTTPS is disabled", ErrInvalidTLSConfig)
+	}
+	baseURL, err := url.Parse(c.BaseAddress)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse base address: %s", ErrInvalidTLSConfig, err.Error())
+	}
+	expectedScheme := "http"
+	if c.EnableHTTPS {
+		expectedScheme = "https"
+	}
+	if baseURL.Scheme != expectedScheme {
+		return fmt.Errorf("%w: base address %s must have scheme %s", ErrInvalidTLSConfig, c.BaseAddress, expectedScheme)
+	}
+	return nil
+}
+
+// GenerateSelfSignedCert makes certificate for local use, which is valid for localhost and given hosts
+func GenerateSelfSignedCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"URL shortener"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	for _, host := range hosts {
+		if host == "" || host == "localhost" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key}, nil
+}
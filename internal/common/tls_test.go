@@ -0,0 +1,50 @@
+package common_test
+
+import (
+	"crypto/x509"
+	"github.com/ffrxp/go-practicum/internal/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  common.Config
+		wantErr bool
+	}{
+		{name: "http", config: common.Config{BaseAddress: "http://localhost:8080"}},
+		{name: "https self-signed", config: common.Config{BaseAddress: "https://localhost:8080", EnableHTTPS: true}},
+		{name: "https with files", config: common.Config{BaseAddress: "https://short.example", EnableHTTPS: true,
+			TLSCertPath: "cert.pem", TLSKeyPath: "key.pem"}},
+		{name: "https base for http", config: common.Config{BaseAddress: "https://localhost:8080"}, wantErr: true},
+		{name: "http base for https", config: common.Config{BaseAddress: "http://localhost:8080", EnableHTTPS: true},
+			wantErr: true},
+		{name: "key without certificate", config: common.Config{BaseAddress: "https://localhost:8080", EnableHTTPS: true,
+			TLSKeyPath: "key.pem"}, wantErr: true},
+		{name: "certificate without HTTPS", config: common.Config{BaseAddress: "http://localhost:8080",
+			TLSCertPath: "cert.pem", TLSKeyPath: "key.pem"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.ValidateTLS()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, common.ErrInvalidTLSConfig)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	cert, err := common.GenerateSelfSignedCert("short.example", "10.0.0.1")
+	require.NoError(t, err)
+	require.Len(t, cert.Certificate, 1)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	for _, host := range []string{"localhost", "127.0.0.1", "short.example", "10.0.0.1"} {
+		assert.NoError(t, parsed.VerifyHostname(host), host)
+	}
+}
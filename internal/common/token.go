@@ -0,0 +1,92 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// User token has form <payload>.<signature>, where payload is JSON with user ID, times of issue and expiry,
+// random nonce and version of format, and signature is HMAC of payload. Both parts are encoded in base64 URL encoding
+
+// userTokenVersion is the current version of format of user token
+const userTokenVersion = 1
+
+const userTokenNonceLength = 16
+
+var ErrInvalidToken = errors.New("common: invalid user token")
+var ErrTokenExpired = errors.New("common: user token expired")
+
+// UserToken identifies user. Times are Unix timestamps in seconds
+type UserToken struct {
+	Version   int    `json:"v"`
+	UserID    int64  `json:"uid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce"`
+}
+
+// NewUserToken makes token for user, which is valid during ttl since now
+func NewUserToken(userID int64, now time.Time, ttl time.Duration) (UserToken, error) {
+	nonce := make([]byte, userTokenNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return UserToken{}, err
+	}
+	return UserToken{
+		Version:   userTokenVersion,
+		UserID:    userID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+// Expires returns time of expiry of token
+func (t UserToken) Expires() time.Time {
+	return time.Unix(t.ExpiresAt, 0)
+}
+
+// EncodeUserToken serializes token and signs it with primary key
+func (k *Keyring) EncodeUserToken(token UserToken) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signature := k.Sign([]byte(encodedPayload))
+	return encodedPayload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// DecodeUserToken checks signature and expiry of token. outdated is true if token is signed with previous key
+func (k *Keyring) DecodeUserToken(value string, now time.Time) (token UserToken, outdated bool, err error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return UserToken{}, false, fmt.Errorf("%w: wrong format", ErrInvalidToken)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return UserToken{}, false, fmt.Errorf("%w: wrong format of signature", ErrInvalidToken)
+	}
+	ok, outdated := k.Verify([]byte(parts[0]), signature)
+	if !ok {
+		return UserToken{}, false, fmt.Errorf("%w: wrong signature", ErrInvalidToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return UserToken{}, false, fmt.Errorf("%w: wrong format of payload", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return UserToken{}, false, fmt.Errorf("%w: wrong format of payload", ErrInvalidToken)
+	}
+	if token.Version != userTokenVersion {
+		return UserToken{}, false, fmt.Errorf("%w: unsupported version %d", ErrInvalidToken, token.Version)
+	}
+	if !now.Before(token.Expires()) {
+		return UserToken{}, false, ErrTokenExpired
+	}
+	return token, outdated, nil
+}
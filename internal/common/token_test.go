@@ -0,0 +1,66 @@
+package common_test
+
+import (
+	"encoding/base64"
+	"github.com/ffrxp/go-practicum/internal/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserToken(t *testing.T) {
+	now := time.Now()
+	keyring, err := common.NewKeyring([]byte("new"), []byte("old"))
+	require.NoError(t, err)
+	oldKeyring, err := common.NewKeyring([]byte("old"))
+	require.NoError(t, err)
+
+	token, err := common.NewUserToken(42, now, time.Hour)
+	require.NoError(t, err)
+	other, err := common.NewUserToken(42, now, time.Hour)
+	require.NoError(t, err)
+	assert.NotEqual(t, token.Nonce, other.Nonce)
+
+	value, err := keyring.EncodeUserToken(token)
+	require.NoError(t, err)
+	decoded, outdated, err := keyring.DecodeUserToken(value, now)
+	require.NoError(t, err)
+	assert.Equal(t, token, decoded)
+	assert.False(t, outdated)
+
+	oldValue, err := oldKeyring.EncodeUserToken(token)
+	require.NoError(t, err)
+	_, outdated, err = keyring.DecodeUserToken(oldValue, now)
+	require.NoError(t, err)
+	assert.True(t, outdated)
+
+	_, _, err = keyring.DecodeUserToken(value, now.Add(time.Hour))
+	assert.ErrorIs(t, err, common.ErrTokenExpired)
+
+	// Payload with other user ID doesn't match signature
+	parts := strings.Split(value, ".")
+	forged := token
+	forged.UserID = 43
+	forgedValue, err := oldKeyring.EncodeUserToken(forged)
+	require.NoError(t, err)
+	forgedParts := strings.Split(forgedValue, ".")
+	for _, invalid := range []string{
+		"",
+		"token42",
+		forgedParts[0] + "." + parts[1],
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("signature")),
+		parts[0] + ".!!!",
+	} {
+		_, _, err = keyring.DecodeUserToken(invalid, now)
+		assert.ErrorIs(t, err, common.ErrInvalidToken, invalid)
+	}
+
+	unsupported := token
+	unsupported.Version = 2
+	unsupportedValue, err := keyring.EncodeUserToken(unsupported)
+	require.NoError(t, err)
+	_, _, err = keyring.DecodeUserToken(unsupportedValue, now)
+	assert.ErrorIs(t, err, common.ErrInvalidToken)
+}
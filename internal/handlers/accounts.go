@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ffrxp/go-practicum/internal/app"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// accountAction is registration or login. It returns ID of account
+type accountAction func(ctx context.Context, currentUserID int64, login string, password string) (int64, error)
+
+func (h *shortenerHandler) register() http.HandlerFunc {
+	return h.accountHandler(h.app.Register, http.StatusCreated)
+}
+
+func (h *shortenerHandler) login() http.HandlerFunc {
+	return h.accountHandler(h.app.Login, http.StatusOK)
+}
+
+// accountHandler performs registration or login and sets cookie of account. Anonymous user from cookie
+// is passed to action, so links made before registration or login are kept
+func (h *shortenerHandler) accountHandler(action accountAction, successStatus int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ct := r.Header.Get("content-type")
+		if ct != "application/json" {
+			http.Error(w, "Invalid content type of request", http.StatusBadRequest)
+			return
+		}
+		var requestParsedBody credentials
+		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+
+		userID, err := action(r.Context(), h.cookieUserID(r), requestParsedBody.Login, requestParsedBody.Password)
+		if err != nil {
+			if errors.Is(err, app.ErrInvalidCredentials) {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			} else if errors.Is(err, app.ErrLoginTaken) {
+				writeJSONError(w, http.StatusConflict, "Login is already taken")
+				return
+			} else if errors.Is(err, app.ErrWrongCredentials) {
+				writeJSONError(w, http.StatusUnauthorized, "Wrong login or password")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userCookie, err := h.createCookie(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := json.Marshal(struct {
+			UserID int64 `json:"user_id"`
+		}{userID})
+		if err != nil {
+			http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+			return
+		}
+
+		setUserCookie(w, userCookie)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(successStatus)
+		_, errWrite := w.Write(resp)
+		if errWrite != nil {
+			log.Printf("Writting error")
+			return
+		}
+	}
+}
+
+// cookieUserID returns ID of user from valid cookie or zero if there is no such cookie. Unlike processCookies,
+// it never creates new user
+func (h *shortenerHandler) cookieUserID(r *http.Request) int64 {
+	userCookie, err := r.Cookie(userCookieName)
+	if err != nil {
+		return 0
+	}
+	token, _, err := h.keyring.DecodeUserToken(userCookie.Value, time.Now())
+	if err != nil || token.UserID == 0 {
+		return 0
+	}
+	if err := h.app.TouchUser(r.Context(), token.UserID, time.Unix(token.IssuedAt, 0)); err != nil {
+		return 0
+	}
+	return token.UserID
+}
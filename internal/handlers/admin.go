@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/app"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// adminRoutes registers admin API. Moderation of links requires moderator or admin token,
+// management of API keys requires admin token
+func (h *shortenerHandler) adminRoutes(r chi.Router) {
+	r.Use(h.middlewareAdmin)
+	r.Get("/urls", h.searchURLs())
+	r.Post("/urls/delete", h.moderateURLs(true))
+	r.Post("/urls/restore", h.moderateURLs(false))
+	r.Get("/users/{userID}/urls", h.returnUserLinks())
+	r.Group(func(r chi.Router) {
+		r.Use(requireAdminRole(adminRoleAdmin))
+		r.Post("/keys", h.issueAPIKey())
+		r.Delete("/keys/{id}", h.revokeAPIKey())
+	})
+}
+
+func (h *shortenerHandler) issueAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestParsedBody := struct {
+			UserID int64 `json:"user_id"`
+		}{}
+		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+		auditAdminAction(r, "issue_api_key", fmt.Sprintf("User ID:%d", requestParsedBody.UserID))
+		issued, err := h.app.IssueAPIKey(r.Context(), requestParsedBody.UserID)
+		if err != nil {
+			if errors.Is(err, app.ErrInvalidUserID) {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			} else if errors.Is(err, app.ErrCantFindUser) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find user")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		auditAdminAction(r, "issue_api_key", "Key ID:"+issued.ID)
+		resp, err := json.Marshal(struct {
+			ID     string `json:"id"`
+			Key    string `json:"key"`
+			UserID int64  `json:"user_id"`
+		}{issued.ID, issued.Key, issued.UserID})
+		if err != nil {
+			http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, errWrite := w.Write(resp)
+		if errWrite != nil {
+			log.Printf("Writting error")
+			return
+		}
+	}
+}
+
+func (h *shortenerHandler) revokeAPIKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyID := chi.URLParam(r, "id")
+		auditAdminAction(r, "revoke_api_key", "Key ID:"+keyID)
+		err := h.app.RevokeAPIKey(r.Context(), keyID)
+		if err != nil {
+			if errors.Is(err, app.ErrCantFindAPIKey) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find API key")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// searchURLs finds links by part of original or short URL from query parameter q
+func (h *shortenerHandler) searchURLs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		auditAdminAction(r, "search_urls", "Query:"+query)
+		limit := 0
+		if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+			var err error
+			if limit, err = strconv.Atoi(rawLimit); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid limit")
+				return
+			}
+		}
+		links, err := h.app.SearchURLs(r.Context(), query, limit)
+		if err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		auditAdminAction(r, "search_urls", fmt.Sprintf("Found:%d", len(links)))
+		writeJSON(w, http.StatusOK, links)
+	}
+}
+
+// moderateURLs marks as deleted or restores links from JSON list of short URLs regardless of their owners
+func (h *shortenerHandler) moderateURLs(deleted bool) http.HandlerFunc {
+	action := "restore_urls"
+	if deleted {
+		action = "delete_urls"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ct := r.Header.Get("content-type")
+		if ct != "application/json" {
+			http.Error(w, "Invalid content type of request", http.StatusBadRequest)
+			return
+		}
+		var requestURLs []string
+		if err := json.Unmarshal(body, &requestURLs); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+		auditAdminAction(r, action, fmt.Sprintf("Short URLs:%s", requestURLs))
+		if err := h.app.SetURLsDeleted(r.Context(), requestURLs, deleted); err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// returnUserLinks returns links of user with their moderation state
+func (h *shortenerHandler) returnUserLinks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		auditAdminAction(r, "list_user_urls", fmt.Sprintf("User ID:%d", userID))
+		links, err := h.app.GetUserLinks(r.Context(), userID)
+		if err != nil {
+			writeModerationError(w, err)
+			return
+		}
+		auditAdminAction(r, "list_user_urls", fmt.Sprintf("Found:%d", len(links)))
+		if len(links) == 0 {
+			w.WriteHeader(204)
+			return
+		}
+		writeJSON(w, http.StatusOK, links)
+	}
+}
+
+func writeModerationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, app.ErrInvalidModeration):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, app.ErrCantFindURL):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, app.ErrCantFindUser):
+		writeJSONError(w, http.StatusNotFound, "Cannot find user")
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
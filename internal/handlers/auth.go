@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/app"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+// userIDContextKey is the key of ID of user authenticated by API key, adminRoleContextKey is the key of role
+// of admin API token, adminAuditContextKey is the key of audit record of admin request
+const (
+	userIDContextKey contextKey = iota
+	adminRoleContextKey
+	adminAuditContextKey
+)
+
+// Roles of admin API tokens. Moderators can only moderate links, admins can also manage API keys
+const (
+	adminRoleModerator = "moderator"
+	adminRoleAdmin     = "admin"
+)
+
+var adminRoleRanks = map[string]int{adminRoleModerator: 1, adminRoleAdmin: 2}
+
+// bearerToken returns token from header "Authorization: Bearer <token>". ok is false if header is not set
+// or has another scheme
+func bearerToken(r *http.Request) (token string, ok bool) {
+	header := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// middlewareAPIKey authenticates user by API key from header "Authorization: Bearer <key>".
+// Authenticated user takes precedence over user from cookie. Requests without header are passed to cookies
+func (h *shortenerHandler) middlewareAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := bearerToken(r)
+		if !ok {
+			next(w, r)
+			return
+		}
+		userID, err := h.app.AuthenticateAPIKey(r.Context(), key)
+		if err != nil {
+			if errors.Is(err, app.ErrInvalidAPIKey) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeJSONError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+			log.Printf("Cannot check API key. Error message:%s\n", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID)))
+	}
+}
+
+// middlewareAdmin passes only requests with admin or moderator token in header "Authorization: Bearer <token>".
+// Role of token is put to context of request. Every request, including denied one, is logged once
+// with status of response and action recorded by handler
+func (h *shortenerHandler) middlewareAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		audit := &adminAudit{}
+		token, _ := bearerToken(r)
+		role := h.adminRole(token)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(sw, http.StatusUnauthorized, "Invalid admin token")
+			logAdminRequest(r, role, sw.status, audit)
+			return
+		}
+		ctx := context.WithValue(r.Context(), adminRoleContextKey, role)
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(ctx, adminAuditContextKey, audit)))
+		logAdminRequest(r, role, sw.status, audit)
+	})
+}
+
+// adminAudit is the action of admin request with its details. Handlers record it by auditAdminAction
+type adminAudit struct {
+	action  string
+	details []string
+}
+
+// auditAdminAction sets action of admin request and adds details to it
+func auditAdminAction(r *http.Request, action string, details ...string) {
+	if audit, ok := r.Context().Value(adminAuditContextKey).(*adminAudit); ok {
+		audit.action = action
+		audit.details = append(audit.details, details...)
+	}
+}
+
+// logAdminRequest writes audit line of admin request. Role is empty if token is invalid
+func logAdminRequest(r *http.Request, role string, status int, audit *adminAudit) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	line := fmt.Sprintf("Admin request. Role:%s|Method:%s|Path:%s|Status:%d", role, r.Method, r.URL.Path, status)
+	if audit.action != "" {
+		line += "|Action:" + audit.action
+	}
+	for _, detail := range audit.details {
+		line += "|" + detail
+	}
+	log.Printf("%s\n", line)
+}
+
+// statusWriter remembers status of response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// adminRole returns role of admin API token or empty string if token is invalid. Tokens, which are not set
+// in config, never match
+func (h *shortenerHandler) adminRole(token string) string {
+	if token == "" {
+		return ""
+	}
+	if h.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1 {
+		return adminRoleAdmin
+	}
+	if h.moderatorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.moderatorToken)) == 1 {
+		return adminRoleModerator
+	}
+	return ""
+}
+
+// requireAdminRole passes only requests, which were authenticated by middlewareAdmin with at least role minRole
+func requireAdminRole(minRole string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := adminRoleFromContext(r.Context())
+			if adminRoleRanks[role] < adminRoleRanks[minRole] {
+				writeJSONError(w, http.StatusForbidden, "Role "+minRole+" is required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminRoleFromContext returns role of admin API token of request
+func adminRoleFromContext(ctx context.Context) string {
+	role, _ := ctx.Value(adminRoleContextKey).(string)
+	return role
+}
+
+// setUserCookie sets cookie with user token. Users authenticated by API key don't get cookie
+func setUserCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	if cookie == nil {
+		return
+	}
+	http.SetCookie(w, cookie)
+}
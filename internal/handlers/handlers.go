@@ -3,7 +3,6 @@ package handlers
 import (
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,40 +13,104 @@ import (
 	"github.com/jackc/pgx/v4/pgxpool"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// deleteWorkerQueryTimeout limits storage calls made by URLsForDeleteWorker,
+// which are not bound to any request context
+const deleteWorkerQueryTimeout = 5 * time.Second
+
+// userCookieName is the name of cookie with user token
+const userCookieName = "token"
+
+// expiredURLsSweepInterval is the period of marking expired short URLs as deleted
+const expiredURLsSweepInterval = time.Minute
+
+// deleteQueueSize is the number of delete requests, which may wait for URLsForDeleteWorker
+const deleteQueueSize = 100
+
 type shortenerHandler struct {
 	*chi.Mux
 	app                   *app.ShortenerApp
-	secKey                []byte
+	keyring               *common.Keyring
+	cookieTTL             time.Duration
+	secureCookies         bool
+	deleteInterval        time.Duration
+	adminToken            string
+	moderatorToken        string
 	URLsForDeleteDataChan chan URLsForDeleteData
+	// stop is closed on shutdown to stop background workers
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
 }
 
-func NewShortenerHandler(sa *app.ShortenerApp) shortenerHandler {
-	h := shortenerHandler{
-		Mux: chi.NewMux(),
-		app: sa,
+func NewShortenerHandler(sa *app.ShortenerApp, config *common.Config) (*shortenerHandler, error) {
+	keyring, err := config.LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+	h := &shortenerHandler{
+		Mux:            chi.NewMux(),
+		app:            sa,
+		keyring:        keyring,
+		cookieTTL:      config.CookieTTL,
+		secureCookies:  config.EnableHTTPS,
+		deleteInterval: config.DeleteWorkerInterval,
+		adminToken:     config.AdminToken,
+		moderatorToken: config.ModeratorToken,
 	}
-	h.Post("/", h.middlewareGzipper(h.postURLCommon()))
-	h.Post("/api/shorten", h.middlewareGzipper(h.postURLByJSON()))
-	h.Post("/api/shorten/batch", h.middlewareGzipper(h.postURLBatch()))
+	h.Post("/", h.middlewareGzipper(h.middlewareAPIKey(h.postURLCommon())))
+	h.Post("/api/shorten", h.middlewareGzipper(h.middlewareAPIKey(h.postURLByJSON())))
+	h.Post("/api/shorten/batch", h.middlewareGzipper(h.middlewareAPIKey(h.postURLBatch())))
 	h.Mux.NotFound(h.badRequest())
 	h.Mux.MethodNotAllowed(h.badRequest())
 	h.Get("/{shortURL}", h.middlewareGzipper(h.getURL()))
 	h.Get("/ping", h.middlewareGzipper(h.pingToDB()))
-	h.Get("/api/user/urls", h.middlewareGzipper(h.returnUserURLs()))
-	h.Delete("/api/user/urls", h.middlewareGzipper(h.deleteURLs()))
-
-	h.secKey = []byte("some_secret_key")
+	h.Get("/api/user/urls", h.middlewareGzipper(h.middlewareAPIKey(h.returnUserURLs())))
+	h.Get("/api/user/urls/{shortURL}/stats", h.middlewareGzipper(h.middlewareAPIKey(h.returnURLStats())))
+	h.Delete("/api/user/urls", h.middlewareGzipper(h.middlewareAPIKey(h.deleteURLs())))
+	h.Post("/api/user/urls/transfer", h.middlewareGzipper(h.middlewareAPIKey(h.transferURLs())))
+	h.Post("/api/user/workspaces", h.middlewareGzipper(h.middlewareAPIKey(h.createWorkspace())))
+	h.Get("/api/user/workspaces", h.middlewareGzipper(h.middlewareAPIKey(h.returnUserWorkspaces())))
+	h.Get("/api/user/workspaces/{workspaceID}/members", h.middlewareGzipper(h.middlewareAPIKey(h.returnWorkspaceMembers())))
+	h.Put("/api/user/workspaces/{workspaceID}/members/{userID}", h.middlewareGzipper(h.middlewareAPIKey(h.setWorkspaceMember())))
+	h.Delete("/api/user/workspaces/{workspaceID}/members/{userID}", h.middlewareGzipper(h.middlewareAPIKey(h.removeWorkspaceMember())))
+	h.Post("/api/user/register", h.middlewareGzipper(h.register()))
+	h.Post("/api/user/login", h.middlewareGzipper(h.login()))
+	if h.adminToken != "" || h.moderatorToken != "" {
+		h.Route("/api/admin", h.adminRoutes)
+	}
 
-	h.URLsForDeleteDataChan = make(chan URLsForDeleteData)
+	h.URLsForDeleteDataChan = make(chan URLsForDeleteData, deleteQueueSize)
+	h.stop = make(chan struct{})
+	h.workers.Add(2)
 	go h.URLsForDeleteWorker()
-	return h
+	go h.ExpiredURLsWorker()
+	return h, nil
+}
+
+// Shutdown stops background workers. Delete requests, which were accepted before, are processed.
+// Handlers must not be called after Shutdown
+func (h *shortenerHandler) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	done := make(chan struct{})
+	go func() {
+		h.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 type gzipWriter struct {
@@ -59,14 +122,12 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-type CookieData struct {
-	UserID int
-	Token  []byte
-}
-
+// processCookieResult is the user of request. userID is zero for visitor, who has not made anything yet.
+// tokenIssuedAt is zero if user is authenticated by API key
 type processCookieResult struct {
-	userID int
-	cookie *http.Cookie
+	userID        int64
+	cookie        *http.Cookie
+	tokenIssuedAt time.Time
 }
 
 type BatchResponse []BatchResponseElem
@@ -74,18 +135,33 @@ type BatchResponse []BatchResponseElem
 type BatchAnswer []BatchAnswerElem
 
 type BatchResponseElem struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	TTLSeconds    int64      `json:"ttl_seconds,omitempty"`
 }
 
 type BatchAnswerElem struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+	ShortURL      string `json:"short_url,omitempty"`
+	Status        string `json:"status"`
+	Message       string `json:"message,omitempty"`
 }
 
+// Statuses of batch answer elements
+const (
+	BatchStatusCreated = "created"
+	BatchStatusExists  = "exists"
+	BatchStatusInvalid = "invalid"
+	BatchStatusBlocked = "blocked"
+	BatchStatusError   = "error"
+	// BatchStatusNotInWorkspace means that short URL is created, but not added to workspace
+	BatchStatusNotInWorkspace = "not_in_workspace"
+)
+
 type URLsForDeleteData struct {
 	URLs   []string
-	userID int
+	userID int64
 }
 
 func (h *shortenerHandler) middlewareGzipper(next http.HandlerFunc) http.HandlerFunc {
@@ -134,21 +210,30 @@ func (h *shortenerHandler) postURLCommon() http.HandlerFunc {
 		}
 
 		resultStatus := 201
-		resultURL, errCreating := h.app.CreateShortURL(string(body), pcr.userID)
+		resultURL, errCreating := h.app.CreateShortURL(r.Context(), string(body), "", time.Time{}, pcr.userID)
 		if errCreating != nil {
-			if errors.Is(errCreating, storage.ErrAlreadyExist) {
-				resultURL, err = h.app.GetExistShortURL(string(body))
+			if errors.Is(errCreating, app.ErrInvalidURL) {
+				writeURLValidationError(w, errCreating)
+				return
+			} else if errors.Is(errCreating, app.ErrDomainBlocked) {
+				writeJSONError(w, http.StatusForbidden, errCreating.Error())
+				return
+			} else if errors.Is(errCreating, storage.ErrAlreadyExist) {
+				resultURL, err = h.app.GetExistShortURL(r.Context(), string(body))
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
 				resultStatus = 409
+			} else if errors.Is(errCreating, app.ErrCantGenerateShortURL) {
+				http.Error(w, errCreating.Error(), http.StatusInternalServerError)
+				return
 			} else {
 				http.Error(w, errCreating.Error(), http.StatusBadRequest)
 				return
 			}
 		}
-		http.SetCookie(w, pcr.cookie)
+		setUserCookie(w, pcr.cookie)
 		w.WriteHeader(resultStatus)
 		_, errWrite := w.Write([]byte(resultURL))
 		if errWrite != nil {
@@ -179,23 +264,73 @@ func (h *shortenerHandler) postURLByJSON() http.HandlerFunc {
 			return
 		}
 		requestParsedBody := struct {
-			URL string `json:"url"`
-		}{URL: ""}
+			URL         string     `json:"url"`
+			Alias       string     `json:"alias"`
+			ExpiresAt   *time.Time `json:"expires_at"`
+			TTLSeconds  int64      `json:"ttl_seconds"`
+			WorkspaceID int64      `json:"workspace_id"`
+		}{URL: "", Alias: ""}
 		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
 			http.Error(w, "Cannot unmarshal JSON request", http.StatusBadRequest)
 			return
 		}
+		expiresAt, err := app.ExpirationTime(requestParsedBody.ExpiresAt, requestParsedBody.TTLSeconds)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
 		resultStatus := 201
-		resultURL, errCreating := h.app.CreateShortURL(requestParsedBody.URL, pcr.userID)
+		var resultURL, errorMessage string
+		var errCreating error
+		if requestParsedBody.WorkspaceID != 0 {
+			resultURL, errCreating = h.app.CreateWorkspaceShortURL(r.Context(), requestParsedBody.URL,
+				requestParsedBody.Alias, expiresAt, pcr.userID, requestParsedBody.WorkspaceID)
+		} else {
+			resultURL, errCreating = h.app.CreateShortURL(r.Context(), requestParsedBody.URL, requestParsedBody.Alias,
+				expiresAt, pcr.userID)
+		}
 		if errCreating != nil {
-			if errors.Is(errCreating, storage.ErrAlreadyExist) {
-				resultURL, err = h.app.GetExistShortURL(requestParsedBody.URL)
+			if errors.Is(errCreating, app.ErrNotAddedToWorkspace) {
+				// Short URL is stored, so client gets it and learns that workspace doesn't have it
+				errorMessage = "Short URL is created, but not added to workspace"
+			} else if errors.Is(errCreating, app.ErrCantFindWorkspace) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find workspace")
+				return
+			} else if errors.Is(errCreating, app.ErrWorkspaceForbidden) {
+				writeJSONError(w, http.StatusForbidden, errCreating.Error())
+				return
+			} else if errors.Is(errCreating, app.ErrInvalidURL) {
+				writeURLValidationError(w, errCreating)
+				return
+			} else if errors.Is(errCreating, app.ErrDomainBlocked) {
+				writeJSONError(w, http.StatusForbidden, errCreating.Error())
+				return
+			} else if errors.Is(errCreating, app.ErrInvalidAlias) {
+				writeAliasError(w, errCreating)
+				return
+			} else if errors.Is(errCreating, app.ErrAliasTaken) {
+				writeJSONError(w, http.StatusConflict, fmt.Sprintf("alias %s is already taken", requestParsedBody.Alias))
+				return
+			} else if errors.Is(errCreating, app.ErrAliasURLExists) {
+				resultURL, err = h.app.GetExistShortURL(r.Context(), requestParsedBody.URL)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				// Client gets existing short URL and learns that alias was not created
+				errorMessage = fmt.Sprintf("URL already has short URL, alias %s is not created", requestParsedBody.Alias)
+				resultStatus = 409
+			} else if errors.Is(errCreating, storage.ErrAlreadyExist) {
+				resultURL, err = h.app.GetExistShortURL(r.Context(), requestParsedBody.URL)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusBadRequest)
 					return
 				}
 				resultStatus = 409
+			} else if errors.Is(errCreating, app.ErrCantGenerateShortURL) {
+				http.Error(w, errCreating.Error(), http.StatusInternalServerError)
+				return
 			} else {
 				http.Error(w, errCreating.Error(), http.StatusBadRequest)
 				return
@@ -204,14 +339,15 @@ func (h *shortenerHandler) postURLByJSON() http.HandlerFunc {
 
 		resultRespBody := struct {
 			Result string `json:"result"`
-		}{Result: resultURL}
+			Error  string `json:"error,omitempty"`
+		}{Result: resultURL, Error: errorMessage}
 		resp, err := json.Marshal(resultRespBody)
 		if err != nil {
 			http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, pcr.cookie)
+		setUserCookie(w, pcr.cookie)
 		w.Header().Set("content-type", "application/json")
 		w.WriteHeader(resultStatus)
 		_, errWrite := w.Write(resp)
@@ -222,6 +358,56 @@ func (h *shortenerHandler) postURLByJSON() http.HandlerFunc {
 	}
 }
 
+// writeJSONError writes error response in form {"error": "message"}
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	resp, err := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: message})
+	if err != nil {
+		http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_, errWrite := w.Write(resp)
+	if errWrite != nil {
+		log.Printf("Writting error")
+	}
+}
+
+// writeAliasError writes reason of rejection of alias without internal error prefix
+func writeAliasError(w http.ResponseWriter, err error) {
+	var aliasErr *app.AliasError
+	if errors.As(err, &aliasErr) {
+		writeJSONError(w, http.StatusBadRequest, "invalid alias: "+aliasErr.Reason)
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "invalid alias")
+}
+
+// writeURLValidationError writes response with status 422 in form {"error": "message", "code": "code"}
+func writeURLValidationError(w http.ResponseWriter, err error) {
+	respBody := struct {
+		Error string `json:"error"`
+		Code  string `json:"code,omitempty"`
+	}{Error: err.Error()}
+	var validationErr *app.URLValidationError
+	if errors.As(err, &validationErr) {
+		respBody.Code = validationErr.Code
+	}
+	resp, errMarshal := json.Marshal(respBody)
+	if errMarshal != nil {
+		http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_, errWrite := w.Write(resp)
+	if errWrite != nil {
+		log.Printf("Writting error")
+	}
+}
+
 func (h *shortenerHandler) postURLBatch() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		pcr, err := h.processCookies(r)
@@ -248,18 +434,40 @@ func (h *shortenerHandler) postURLBatch() http.HandlerFunc {
 			http.Error(w, "Cannot unmarshal JSON request", http.StatusBadRequest)
 			return
 		}
+		batchAns := make(BatchAnswer, len(batchResp))
 		var urlsForShortener []string
-		for _, respElem := range batchResp {
+		var expirations []time.Time
+		var validIdx []int
+		for i, respElem := range batchResp {
+			batchAns[i].CorrelationID = respElem.CorrelationID
+			expiresAt, err := app.ExpirationTime(respElem.ExpiresAt, respElem.TTLSeconds)
+			if err != nil {
+				batchAns[i].Status = BatchStatusInvalid
+				batchAns[i].Message = err.Error()
+				continue
+			}
 			urlsForShortener = append(urlsForShortener, respElem.OriginalURL)
+			expirations = append(expirations, expiresAt)
+			validIdx = append(validIdx, i)
 		}
-		shortURLs, errCreating := h.app.CreateShortURLs(urlsForShortener, pcr.userID)
-		if errCreating != nil {
-			http.Error(w, errCreating.Error(), http.StatusBadRequest)
-			return
+		// Links of batch are added to workspace from query parameter workspace_id
+		var results []app.ShortURLResult
+		if r.URL.Query().Get("workspace_id") != "" {
+			workspaceID, err := strconv.ParseInt(r.URL.Query().Get("workspace_id"), 10, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid workspace ID")
+				return
+			}
+			results, err = h.app.CreateWorkspaceShortURLs(r.Context(), urlsForShortener, expirations, pcr.userID, workspaceID)
+			if err != nil {
+				writeWorkspaceError(w, err)
+				return
+			}
+		} else if len(validIdx) > 0 {
+			results = h.app.CreateShortURLs(r.Context(), urlsForShortener, expirations, pcr.userID)
 		}
-		var batchAns BatchAnswer
-		for i := 0; i < len(shortURLs); i++ {
-			batchAns = append(batchAns, BatchAnswerElem{batchResp[i].CorrelationID, shortURLs[i]})
+		for j, i := range validIdx {
+			fillBatchAnswerElem(&batchAns[i], results[j])
 		}
 		resp, err := json.Marshal(batchAns)
 		if err != nil {
@@ -267,9 +475,9 @@ func (h *shortenerHandler) postURLBatch() http.HandlerFunc {
 			return
 		}
 
-		http.SetCookie(w, pcr.cookie)
+		setUserCookie(w, pcr.cookie)
 		w.Header().Set("content-type", "application/json")
-		w.WriteHeader(201)
+		w.WriteHeader(batchStatusCode(batchAns))
 		_, errWrite := w.Write(resp)
 		if errWrite != nil {
 			log.Printf("Writting error")
@@ -278,6 +486,59 @@ func (h *shortenerHandler) postURLBatch() http.HandlerFunc {
 	}
 }
 
+func fillBatchAnswerElem(elem *BatchAnswerElem, result app.ShortURLResult) {
+	switch {
+	case result.Err == nil && result.Created:
+		elem.Status = BatchStatusCreated
+	case result.Err == nil:
+		elem.Status = BatchStatusExists
+	case errors.Is(result.Err, app.ErrInvalidURL):
+		elem.Status = BatchStatusInvalid
+	case errors.Is(result.Err, app.ErrDomainBlocked):
+		elem.Status = BatchStatusBlocked
+	case errors.Is(result.Err, app.ErrNotAddedToWorkspace):
+		elem.Status = BatchStatusNotInWorkspace
+	default:
+		elem.Status = BatchStatusError
+	}
+	elem.ShortURL = result.ShortURL
+	if result.Err != nil {
+		elem.Message = result.Err.Error()
+	}
+}
+
+// batchStatusCode returns 201 if all elements of batch are created, 207 if some of them
+// are not created, but batch is partially successful, and error code if nothing succeeded
+func batchStatusCode(batchAns BatchAnswer) int {
+	created, succeeded, invalid, blocked := 0, 0, 0, 0
+	for _, elem := range batchAns {
+		switch elem.Status {
+		case BatchStatusCreated:
+			created++
+			succeeded++
+		case BatchStatusExists, BatchStatusNotInWorkspace:
+			succeeded++
+		case BatchStatusInvalid:
+			invalid++
+		case BatchStatusBlocked:
+			blocked++
+		}
+	}
+	switch {
+	case created == len(batchAns):
+		return http.StatusCreated
+	case succeeded > 0:
+		return http.StatusMultiStatus
+	case invalid == len(batchAns):
+		return http.StatusBadRequest
+	case blocked == len(batchAns):
+		return http.StatusForbidden
+	case invalid+blocked == len(batchAns):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *shortenerHandler) getURL() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Нужно ли в этом обработчике создавать куки? На функционал они не повлияют, но юзера можно зафиксировать уже здесь
@@ -286,11 +547,14 @@ func (h *shortenerHandler) getURL() http.HandlerFunc {
 		if strings.Contains(paramURL, "/") {
 			http.Error(w, "URL contains invalid symbol", http.StatusBadRequest)
 		}
-		origURL, err := h.app.GetOrigURL(paramURL)
+		origURL, err := h.app.GetOrigURL(r.Context(), paramURL)
 		if err != nil {
-			if errors.Is(err, app.ErrURLDeleted) {
+			if errors.Is(err, app.ErrURLDeleted) || errors.Is(err, app.ErrURLExpired) {
 				w.WriteHeader(410)
 				return
+			} else if errors.Is(err, app.ErrDomainBlocked) {
+				http.Error(w, "Redirect to this domain is blocked", http.StatusForbidden)
+				return
 			} else if errors.Is(err, app.ErrCantFindURL) {
 				http.Error(w, "Cannot find full URL for this short URL", http.StatusBadRequest)
 				return
@@ -299,36 +563,102 @@ func (h *shortenerHandler) getURL() http.HandlerFunc {
 				return
 			}
 		}
+		h.app.RecordClick(storage.ClickEvent{
+			ShortURL:  paramURL,
+			Time:      time.Now(),
+			Referrer:  r.Referer(),
+			UserAgent: r.UserAgent(),
+			Country:   countryFromHeaders(r.Header),
+		})
 		w.Header().Set("Location", origURL)
 		w.WriteHeader(307)
 	}
 }
 
+// countryHeaders are headers with ISO country code of client, which are set by CDN or proxy before service
+var countryHeaders = []string{"CF-IPCountry", "X-Country-Code", "X-Geo-Country"}
+
+func countryFromHeaders(header http.Header) string {
+	for _, name := range countryHeaders {
+		country := strings.ToUpper(strings.TrimSpace(header.Get(name)))
+		if len(country) != 2 {
+			continue
+		}
+		if country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+			continue
+		}
+		return country
+	}
+	return ""
+}
+
+func (h *shortenerHandler) returnURLStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		shortURL := chi.URLParam(r, "shortURL")
+		stats, err := h.app.GetClickStats(r.Context(), pcr.userID, shortURL)
+		if err != nil {
+			if errors.Is(err, app.ErrCantFindURL) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find short URL in user history")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := json.Marshal(struct {
+			ShortURL string `json:"short_url"`
+			*storage.ClickStats
+		}{fmt.Sprintf("%s/%s", h.app.BaseAddress, shortURL), stats})
+		if err != nil {
+			http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+			return
+		}
+
+		setUserCookie(w, pcr.cookie)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(200)
+		_, errWrite := w.Write(resp)
+		if errWrite != nil {
+			log.Printf("Writting error")
+			return
+		}
+	}
+}
+
 func (h *shortenerHandler) returnUserURLs() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pcr, err := h.processCookies(r)
+		pcr, err := h.identifyUser(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		userHaveHistoryURLs, err := h.app.UserHaveHistoryURLs(pcr.userID)
+		if r.URL.Query().Get("workspace_id") != "" {
+			h.returnWorkspaceURLs(w, r, pcr)
+			return
+		}
+		userHaveHistoryURLs, err := h.app.UserHaveHistoryURLs(r.Context(), pcr.userID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		if !userHaveHistoryURLs {
-			http.SetCookie(w, pcr.cookie)
+			setUserCookie(w, pcr.cookie)
 			w.WriteHeader(204)
 			return
 		}
-		history, err := h.app.GetHistoryURLsForUser(pcr.userID)
+		history, err := h.app.GetHistoryURLsForUser(r.Context(), pcr.userID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, pcr.cookie)
+		setUserCookie(w, pcr.cookie)
 		w.Header().Set("content-type", "application/json")
 		w.WriteHeader(200)
 		_, errWrite := w.Write(history)
@@ -349,7 +679,7 @@ func (h *shortenerHandler) badRequest() http.HandlerFunc {
 func (h *shortenerHandler) pingToDB() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Нужно ли в этом обработчике создавать куки? На функционал они не повлияют, но юзера можно зафиксировать уже здесь
-		dbpool, err := pgxpool.Connect(context.Background(), h.app.DatabasePath)
+		dbpool, err := pgxpool.Connect(r.Context(), h.app.DatabasePath)
 		if err != nil {
 			w.WriteHeader(500)
 			return
@@ -361,7 +691,7 @@ func (h *shortenerHandler) pingToDB() http.HandlerFunc {
 
 func (h *shortenerHandler) deleteURLs() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pcr, err := h.processCookies(r)
+		pcr, err := h.identifyUser(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -384,104 +714,257 @@ func (h *shortenerHandler) deleteURLs() http.HandlerFunc {
 			http.Error(w, "Cannot unmarshal JSON request", http.StatusBadRequest)
 			return
 		}
-		go func(URLs []string, userID int) {
-			h.URLsForDeleteDataChan <- URLsForDeleteData{URLs, userID}
-		}(requestURLs, pcr.userID)
+		select {
+		case h.URLsForDeleteDataChan <- URLsForDeleteData{requestURLs, pcr.userID}:
+		case <-r.Context().Done():
+			http.Error(w, "Request canceled", http.StatusServiceUnavailable)
+			return
+		}
 		w.WriteHeader(202)
 	}
 }
 
+// transferURLs transfers short URLs of user to another member of user workspaces or to holder of API key
+func (h *shortenerHandler) transferURLs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ct := r.Header.Get("content-type")
+		if ct != "application/json" {
+			http.Error(w, "Invalid content type of request", http.StatusBadRequest)
+			return
+		}
+		requestParsedBody := struct {
+			ShortURLs  []string `json:"short_urls"`
+			ToUserID   int64    `json:"to_user_id"`
+			ToAPIKeyID string   `json:"to_api_key_id"`
+		}{}
+		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+
+		err = h.app.TransferURLs(r.Context(), pcr.userID, requestParsedBody.ShortURLs,
+			app.TransferTarget{UserID: requestParsedBody.ToUserID, APIKeyID: requestParsedBody.ToAPIKeyID})
+		if err != nil {
+			if errors.Is(err, app.ErrInvalidTransfer) {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			} else if errors.Is(err, app.ErrCantFindUser) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find user")
+				return
+			} else if errors.Is(err, app.ErrCantFindURL) {
+				writeJSONError(w, http.StatusNotFound, "Cannot find short URL in user history")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Recipient is echoed as it was given, so holder of API key is not revealed by ID
+		resp, err := json.Marshal(struct {
+			ToUserID   int64    `json:"to_user_id,omitempty"`
+			ToAPIKeyID string   `json:"to_api_key_id,omitempty"`
+			ShortURLs  []string `json:"short_urls"`
+		}{requestParsedBody.ToUserID, requestParsedBody.ToAPIKeyID, requestParsedBody.ShortURLs})
+		if err != nil {
+			http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+			return
+		}
+
+		setUserCookie(w, pcr.cookie)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(200)
+		_, errWrite := w.Write(resp)
+		if errWrite != nil {
+			log.Printf("Writting error")
+			return
+		}
+	}
+}
+
+// URLsForDeleteWorker collects URLs for delete and marks them as deleted by batches. On shutdown it processes
+// requests left in queue and flushes pending batch
 func (h *shortenerHandler) URLsForDeleteWorker() {
+	defer h.workers.Done()
 	var checkedURLsForDel []string
 
 	// Непонятно, на основании какого критерия нужно перестать собирать URL для выполнения batch запроса.
 	// Когда перестанут поступать URL в канал, по определенному количеству или по временному лимиту?
 	// Решил сделать по временному лимиту
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(h.deleteInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case data := <-h.URLsForDeleteDataChan:
-			for _, URLForDel := range data.URLs {
-				allowedForDel, err := h.app.UserHaveURLinHistory(data.userID, URLForDel)
-				if err != nil {
-					log.Printf("Error in checking if URL belong to user. Error message:%s\n", err.Error())
-				}
-				if !allowedForDel {
-					continue
-				}
-				URLExist, err := h.app.ShortURLExist(URLForDel)
-				if err != nil {
-					log.Printf("Error in checking URL existing. Error message:%s\n", err.Error())
-				}
-				if !URLExist {
-					continue
+			checkedURLsForDel = append(checkedURLsForDel, h.checkURLsForDelete(data)...)
+		case <-ticker.C:
+			h.deleteBatchURLs(checkedURLsForDel)
+			checkedURLsForDel = nil
+		case <-h.stop:
+			for {
+				select {
+				case data := <-h.URLsForDeleteDataChan:
+					checkedURLsForDel = append(checkedURLsForDel, h.checkURLsForDelete(data)...)
+				default:
+					h.deleteBatchURLs(checkedURLsForDel)
+					return
 				}
-				checkedURLsForDel = append(checkedURLsForDel, URLForDel)
 			}
+		}
+	}
+}
+
+// checkURLsForDelete returns URLs, which exist and belong to user or to workspace, where user may delete them
+func (h *shortenerHandler) checkURLsForDelete(data URLsForDeleteData) []string {
+	var checkedURLsForDel []string
+	ctx, cancelFunc := context.WithTimeout(context.Background(), deleteWorkerQueryTimeout)
+	defer cancelFunc()
+	for _, URLForDel := range data.URLs {
+		allowedForDel, err := h.app.UserCanDeleteURL(ctx, data.userID, URLForDel)
+		if err != nil {
+			log.Printf("Error in checking if URL belong to user. Error message:%s\n", err.Error())
+		}
+		if !allowedForDel {
+			continue
+		}
+		URLExist, err := h.app.ShortURLExist(ctx, URLForDel)
+		if err != nil {
+			log.Printf("Error in checking URL existing. Error message:%s\n", err.Error())
+		}
+		if !URLExist {
+			continue
+		}
+		checkedURLsForDel = append(checkedURLsForDel, URLForDel)
+	}
+	return checkedURLsForDel
+}
+
+func (h *shortenerHandler) deleteBatchURLs(URLs []string) {
+	if len(URLs) == 0 {
+		return
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), deleteWorkerQueryTimeout)
+	defer cancelFunc()
+	if err := h.app.MarkDeleteBatchURLs(ctx, URLs); err != nil {
+		log.Printf("Cannot delete batch URLs. Error message:%s\n", err.Error())
+	}
+}
+
+// ExpiredURLsWorker periodically marks expired short URLs as deleted
+func (h *shortenerHandler) ExpiredURLsWorker() {
+	defer h.workers.Done()
+	ticker := time.NewTicker(expiredURLsSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
 		case <-ticker.C:
-			if len(checkedURLsForDel) > 0 {
-				err := h.app.MarkDeleteBatchURLs(checkedURLsForDel)
-				checkedURLsForDel = nil
-				if err != nil {
-					log.Printf("Cannot delete batch URLs. Error message:%s\n", err.Error())
-				}
+			ctx, cancelFunc := context.WithTimeout(context.Background(), deleteWorkerQueryTimeout)
+			_, err := h.app.MarkDeleteExpiredURLs(ctx)
+			cancelFunc()
+			if err != nil {
+				log.Printf("Cannot mark expired URLs. Error message:%s\n", err.Error())
 			}
+		case <-h.stop:
+			return
 		}
 	}
 }
 
-func (h *shortenerHandler) createCookie(cookieName string, userID int) (*http.Cookie, error) {
-	token := common.GetUserToken(userID)
-	signedToken := common.SignMsg([]byte(token), h.secKey)
+// userCookie makes cookie with token, which lives until expiry of token
+func (h *shortenerHandler) userCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     userCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(time.Until(expires).Seconds()),
+		HttpOnly: true,
+		Secure:   h.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
 
-	JSONCookieBody, err := json.Marshal(CookieData{userID, signedToken})
+func (h *shortenerHandler) createCookie(userID int64) (*http.Cookie, error) {
+	token, err := common.NewUserToken(userID, time.Now(), h.cookieTTL)
 	if err != nil {
 		return nil, err
 	}
-	userCookie := &http.Cookie{
-		Name:   cookieName,
-		Value:  url.QueryEscape(string(JSONCookieBody)),
-		MaxAge: 1200,
+	value, err := h.keyring.EncodeUserToken(token)
+	if err != nil {
+		return nil, err
 	}
-	return userCookie, nil
+	return h.userCookie(value, token.Expires()), nil
 }
 
-func (h *shortenerHandler) processCookies(r *http.Request) (processCookieResult, error) {
-	userID := int(rand.Int31())
+// identifyUser identifies user by token from cookie without access to storage. Visitor without valid token
+// gets token without user ID, user is registered only when visitor makes something, see processCookies.
+// Token is renewed if it is signed with previous key or more than half of its lifetime has passed.
+// User authenticated by API key is returned without cookie
+func (h *shortenerHandler) identifyUser(r *http.Request) (processCookieResult, error) {
+	if userID, ok := r.Context().Value(userIDContextKey).(int64); ok {
+		return processCookieResult{userID: userID}, nil
+	}
+	userCookie, err := r.Cookie(userCookieName)
+	if err == nil {
+		token, outdated, err := h.keyring.DecodeUserToken(userCookie.Value, time.Now())
+		if err == nil {
+			issuedAt := time.Unix(token.IssuedAt, 0)
+			if outdated || time.Until(token.Expires()) < h.cookieTTL/2 {
+				userCookie, err = h.createCookie(token.UserID)
+				if err != nil {
+					return processCookieResult{token.UserID, nil, issuedAt}, err
+				}
+				return processCookieResult{token.UserID, userCookie, time.Now()}, nil
+			}
+			return processCookieResult{token.UserID, h.userCookie(userCookie.Value, token.Expires()), issuedAt}, nil
+		}
+		log.Printf("User token is rejected. Error message:%s\n", err.Error())
+	}
 
-	// Process cookies
-	cookieName := "token"
-	userCookie, err := r.Cookie(cookieName)
+	userCookie, err = h.createCookie(0)
 	if err != nil {
-		if !errors.Is(err, http.ErrNoCookie) {
-			return processCookieResult{userID, nil}, err
-		}
-		userCookie, err = h.createCookie(cookieName, userID)
-		if err != nil {
-			return processCookieResult{userID, nil}, err
+		return processCookieResult{}, err
+	}
+	return processCookieResult{cookie: userCookie}, nil
+}
+
+// processCookies identifies user like identifyUser and registers visitor as new user. It is used by handlers,
+// which save something on behalf of user. Token of unknown user is replaced with token of new user
+func (h *shortenerHandler) processCookies(r *http.Request) (processCookieResult, error) {
+	pcr, err := h.identifyUser(r)
+	if err != nil {
+		return pcr, err
+	}
+	if pcr.userID != 0 {
+		if pcr.tokenIssuedAt.IsZero() {
+			return pcr, nil
 		}
-	} else {
-		// Checking sign of cookie
-		curCookieValue := CookieData{}
-		cookieValueUnescaped, err := url.QueryUnescape(userCookie.Value)
-		if err != nil {
-			return processCookieResult{userID, nil}, err
+		err := h.app.TouchUser(r.Context(), pcr.userID, pcr.tokenIssuedAt)
+		if err == nil {
+			return pcr, nil
 		}
-		err = json.Unmarshal([]byte(cookieValueUnescaped), &curCookieValue)
-		if err != nil {
-			return processCookieResult{userID, nil}, err
+		if !errors.Is(err, app.ErrCantFindUser) {
+			return processCookieResult{}, err
 		}
-		expectedToken := common.GetUserToken(curCookieValue.UserID)
-		signedExpectedToken := common.SignMsg([]byte(expectedToken), h.secKey)
+		log.Printf("User token is rejected. Error message:%s\n", err.Error())
+	}
 
-		if hmac.Equal(curCookieValue.Token, signedExpectedToken) {
-			userID = curCookieValue.UserID
-		} else {
-			userCookie, err = h.createCookie(cookieName, userID)
-			if err != nil {
-				return processCookieResult{userID, nil}, err
-			}
-		}
+	userID, err := h.app.CreateUser(r.Context())
+	if err != nil {
+		return processCookieResult{}, err
+	}
+	userCookie, err := h.createCookie(userID)
+	if err != nil {
+		return processCookieResult{userID: userID}, err
 	}
-	return processCookieResult{userID, userCookie}, nil
+	return processCookieResult{userID, userCookie, time.Now()}, nil
 }
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ffrxp/go-practicum/internal/app"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func (h *shortenerHandler) createWorkspace() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.processCookies(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ct := r.Header.Get("content-type")
+		if ct != "application/json" {
+			http.Error(w, "Invalid content type of request", http.StatusBadRequest)
+			return
+		}
+		requestParsedBody := struct {
+			Name string `json:"name"`
+		}{}
+		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+
+		workspace, err := h.app.CreateWorkspace(r.Context(), pcr.userID, requestParsedBody.Name)
+		if err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+		setUserCookie(w, pcr.cookie)
+		writeJSON(w, http.StatusCreated, storage.WorkspaceMembership{Workspace: *workspace, Role: app.RoleOwner})
+	}
+}
+
+func (h *shortenerHandler) returnUserWorkspaces() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		workspaces, err := h.app.GetUserWorkspaces(r.Context(), pcr.userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setUserCookie(w, pcr.cookie)
+		if len(workspaces) == 0 {
+			w.WriteHeader(204)
+			return
+		}
+		writeJSON(w, http.StatusOK, workspaces)
+	}
+}
+
+func (h *shortenerHandler) returnWorkspaceMembers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		workspaceID, err := strconv.ParseInt(chi.URLParam(r, "workspaceID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid workspace ID")
+			return
+		}
+		members, err := h.app.GetWorkspaceMembers(r.Context(), pcr.userID, workspaceID)
+		if err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+		setUserCookie(w, pcr.cookie)
+		writeJSON(w, http.StatusOK, members)
+	}
+}
+
+func (h *shortenerHandler) setWorkspaceMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		workspaceID, memberID, ok := workspaceMemberParams(w, r)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requestParsedBody := struct {
+			Role string `json:"role"`
+		}{}
+		if err := json.Unmarshal(body, &requestParsedBody); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Cannot unmarshal JSON request")
+			return
+		}
+
+		err = h.app.SetWorkspaceMember(r.Context(), pcr.userID, workspaceID, memberID, requestParsedBody.Role)
+		if err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+		setUserCookie(w, pcr.cookie)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *shortenerHandler) removeWorkspaceMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pcr, err := h.identifyUser(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		workspaceID, memberID, ok := workspaceMemberParams(w, r)
+		if !ok {
+			return
+		}
+		if err := h.app.RemoveWorkspaceMember(r.Context(), pcr.userID, workspaceID, memberID); err != nil {
+			writeWorkspaceError(w, err)
+			return
+		}
+		setUserCookie(w, pcr.cookie)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// returnWorkspaceURLs writes links of workspace from query parameter workspace_id
+func (h *shortenerHandler) returnWorkspaceURLs(w http.ResponseWriter, r *http.Request, pcr processCookieResult) {
+	workspaceID, err := strconv.ParseInt(r.URL.Query().Get("workspace_id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid workspace ID")
+		return
+	}
+	history, err := h.app.GetHistoryURLsForWorkspace(r.Context(), pcr.userID, workspaceID)
+	if err != nil {
+		if errors.Is(err, storage.ErrEmptyResult) {
+			setUserCookie(w, pcr.cookie)
+			w.WriteHeader(204)
+			return
+		}
+		writeWorkspaceError(w, err)
+		return
+	}
+
+	setUserCookie(w, pcr.cookie)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	_, errWrite := w.Write(history)
+	if errWrite != nil {
+		log.Printf("Writting error")
+	}
+}
+
+// workspaceMemberParams parses IDs of workspace and member from URL. Error response is written if they are invalid
+func workspaceMemberParams(w http.ResponseWriter, r *http.Request) (workspaceID int64, memberID int64, ok bool) {
+	workspaceID, err := strconv.ParseInt(chi.URLParam(r, "workspaceID"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid workspace ID")
+		return 0, 0, false
+	}
+	memberID, err = strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, 0, false
+	}
+	return workspaceID, memberID, true
+}
+
+func writeWorkspaceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, app.ErrInvalidWorkspace):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, app.ErrCantFindWorkspace):
+		writeJSONError(w, http.StatusNotFound, "Cannot find workspace")
+	case errors.Is(err, app.ErrCantFindUser):
+		writeJSONError(w, http.StatusNotFound, "Cannot find user")
+	case errors.Is(err, app.ErrWorkspaceForbidden):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeJSON writes value as JSON response with given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	resp, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Cannot marshal JSON response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_, errWrite := w.Write(resp)
+	if errWrite != nil {
+		log.Printf("Writting error")
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// APIKey describes key of API client. Storage keeps only SHA-256 hash of key, key itself is shown once on issue.
+// Zero RevokedAt means that key is active
+type APIKey struct {
+	ID        string    `json:"id"`
+	KeyHash   string    `json:"key_hash"`
+	UserID    int64     `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+func (ms *dataStorage) AddAPIKey(ctx context.Context, key APIKey) error {
+	log.Printf("Add API key to storage. ID:%s|User ID:%d\n", key.ID, key.UserID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.addAPIKey(key); err != nil {
+		return err
+	}
+	return ms.appendToJournal(apiKeyRecord(key))
+}
+
+// addAPIKey adds key to maps. Caller must hold write lock
+func (ms *dataStorage) addAPIKey(key APIKey) error {
+	if _, ok := ms.apiKeys[key.ID]; ok {
+		log.Println("Result: conflict. API key already exist")
+		return ErrAlreadyExist
+	}
+	if _, ok := ms.apiKeyHashes[key.KeyHash]; ok {
+		log.Println("Result: conflict. API key already exist")
+		return ErrAlreadyExist
+	}
+	stored := key
+	ms.apiKeys[key.ID] = &stored
+	ms.apiKeyHashes[key.KeyHash] = key.ID
+	ms.noteUserID(key.UserID)
+	return nil
+}
+
+func (ms *dataStorage) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	key, ok := ms.apiKeys[id]
+	if !ok {
+		return nil, ErrEmptyResult
+	}
+	result := *key
+	return &result, nil
+}
+
+func (ms *dataStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	id, ok := ms.apiKeyHashes[keyHash]
+	if !ok {
+		return nil, ErrEmptyResult
+	}
+	key := *ms.apiKeys[id]
+	return &key, nil
+}
+
+func (ms *dataStorage) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	log.Printf("Revoke API key. ID:%s\n", id)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key, ok := ms.apiKeys[id]
+	if !ok {
+		return ErrEmptyResult
+	}
+	if !key.RevokedAt.IsZero() {
+		return nil
+	}
+	key.RevokedAt = revokedAt
+	return ms.appendToJournal(apiKeyRecord(*key))
+}
+
+func (dbs *databaseStorage) AddAPIKey(ctx context.Context, key APIKey) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Add API key to database. ID:%s|User ID:%d\n", key.ID, key.UserID)
+	_, err := dbs.pool.Exec(ctx, "INSERT INTO api_keys (id, key_hash, user_id, created_at) VALUES ($1, $2, $3, $4)",
+		key.ID, key.KeyHash, key.UserID, key.CreatedAt)
+	if err != nil {
+		log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrAlreadyExist
+		}
+		return err
+	}
+	return nil
+}
+
+func (dbs *databaseStorage) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	return dbs.queryAPIKey(ctx, "WHERE id = $1", id)
+}
+
+func (dbs *databaseStorage) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	return dbs.queryAPIKey(ctx, "WHERE key_hash = $1", keyHash)
+}
+
+func (dbs *databaseStorage) queryAPIKey(ctx context.Context, condition string, arg interface{}) (*APIKey, error) {
+	var key APIKey
+	var revokedAt *time.Time
+	err := dbs.pool.QueryRow(ctx,
+		"SELECT id, key_hash, user_id, created_at, revoked_at FROM api_keys "+condition, arg).
+		Scan(&key.ID, &key.KeyHash, &key.UserID, &key.CreatedAt, &revokedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEmptyResult
+		}
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	key.RevokedAt = timeOrZero(revokedAt)
+	return &key, nil
+}
+
+func (dbs *databaseStorage) RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Revoke API key in database. ID:%s\n", id)
+	tag, err := dbs.pool.Exec(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $1) WHERE id = $2", revokedAt, id)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrEmptyResult
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"sort"
+	"time"
+)
+
+// ClickEvent describes one redirect by short URL
+type ClickEvent struct {
+	ShortURL  string    `json:"-"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// DailyClicks is the number of clicks made during one day in UTC. Date has form YYYY-MM-DD
+type DailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int    `json:"clicks"`
+}
+
+// ClickStats is the summary of clicks by short URL. Daily contains only days with clicks sorted by date
+type ClickStats struct {
+	Total int           `json:"total"`
+	Daily []DailyClicks `json:"daily"`
+}
+
+const clickDateLayout = "2006-01-02"
+
+// AddClicks keeps click events. Events older than retention period are rolled up into daily counters
+// by RollUpClicks
+func (ms *dataStorage) AddClicks(ctx context.Context, events []ClickEvent) error {
+	log.Printf("Add clicks to storage. Number of clicks:%d\n", len(events))
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	records := make([]journalRecord, 0, len(events))
+	for _, event := range events {
+		ms.clickEvents[event.ShortURL] = append(ms.clickEvents[event.ShortURL], event)
+		records = append(records, clickRecord(event))
+	}
+	return ms.appendToJournal(records...)
+}
+
+// RollUpClicks replaces click events made before given time with daily counters
+func (ms *dataStorage) RollUpClicks(ctx context.Context, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	rolledUp := ms.rollUpClicks(before)
+	if rolledUp == 0 {
+		return nil
+	}
+	log.Printf("Roll up clicks in storage. Number of clicks:%d\n", rolledUp)
+	return ms.appendToJournal(rollUpClicksRecord(before))
+}
+
+// rollUpClicks moves click events made before given time to daily counters and returns number of moved events.
+// Caller must hold write lock
+func (ms *dataStorage) rollUpClicks(before time.Time) int {
+	rolledUp := 0
+	for shortURL, events := range ms.clickEvents {
+		kept := events[:0]
+		for _, event := range events {
+			if event.Time.Before(before) {
+				ms.addDailyClicks(shortURL, clickDate(event.Time), 1)
+				rolledUp++
+				continue
+			}
+			kept = append(kept, event)
+		}
+		if len(kept) == 0 {
+			delete(ms.clickEvents, shortURL)
+		} else {
+			ms.clickEvents[shortURL] = kept
+		}
+	}
+	return rolledUp
+}
+
+// addDailyClicks increases counter of clicks of short URL for date. Caller must hold write lock
+func (ms *dataStorage) addDailyClicks(shortURL string, date string, clicks int) {
+	daily, ok := ms.clicks[shortURL]
+	if !ok {
+		daily = make(map[string]int)
+		ms.clicks[shortURL] = daily
+	}
+	daily[date] += clicks
+}
+
+func clickDate(t time.Time) string {
+	return t.UTC().Format(clickDateLayout)
+}
+
+func (ms *dataStorage) GetClickStats(ctx context.Context, shortURL string) (*ClickStats, error) {
+	log.Printf("Get click stats. Short URL:%s\n", shortURL)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	byDay := make(map[string]int)
+	for date, clicks := range ms.clicks[shortURL] {
+		byDay[date] += clicks
+	}
+	for _, event := range ms.clickEvents[shortURL] {
+		byDay[clickDate(event.Time)]++
+	}
+	stats := &ClickStats{Daily: make([]DailyClicks, 0, len(byDay))}
+	for date, clicks := range byDay {
+		stats.Total += clicks
+		stats.Daily = append(stats.Daily, DailyClicks{date, clicks})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+	return stats, nil
+}
+
+func (dbs *databaseStorage) AddClicks(ctx context.Context, events []ClickEvent) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Add clicks to database. Number of clicks:%d\n", len(events))
+	rows := make([][]interface{}, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, []interface{}{event.ShortURL, event.Time, event.Referrer, event.UserAgent, event.Country})
+	}
+	_, err := dbs.pool.CopyFrom(ctx, pgx.Identifier{"clicks"},
+		[]string{"short_url", "clicked_at", "referrer", "user_agent", "country"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		log.Printf("Exec copy query error. Error message:%s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+// RollUpClicks replaces click events made before given time with daily counters in one statement
+func (dbs *databaseStorage) RollUpClicks(ctx context.Context, before time.Time) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	tag, err := dbs.pool.Exec(ctx,
+		`WITH rolled AS (DELETE FROM clicks WHERE clicked_at < $1 RETURNING short_url, clicked_at)
+		INSERT INTO click_daily (short_url, day, clicks)
+		SELECT short_url, (clicked_at AT TIME ZONE 'UTC')::date, count(*) FROM rolled GROUP BY 1, 2
+		ON CONFLICT (short_url, day) DO UPDATE SET clicks = click_daily.clicks + EXCLUDED.clicks`, before)
+	if err != nil {
+		log.Printf("Exec roll up query error. Error message:%s\n", err.Error())
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		log.Printf("Roll up clicks in database. Number of days:%d\n", tag.RowsAffected())
+	}
+	return nil
+}
+
+func (dbs *databaseStorage) GetClickStats(ctx context.Context, shortURL string) (*ClickStats, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Get click stats. Short URL:%s\n", shortURL)
+	rows, err := dbs.pool.Query(ctx,
+		`SELECT day, sum(clicks)::bigint FROM (
+			SELECT to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*) AS clicks FROM clicks
+			WHERE short_url = $1 GROUP BY day
+			UNION ALL
+			SELECT to_char(day, 'YYYY-MM-DD'), clicks FROM click_daily WHERE short_url = $1
+		) AS days GROUP BY day ORDER BY day`, shortURL)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	stats := &ClickStats{Daily: make([]DailyClicks, 0)}
+	for rows.Next() {
+		var day DailyClicks
+		if err := rows.Scan(&day.Date, &day.Clicks); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		stats.Total += day.Clicks
+		stats.Daily = append(stats.Daily, day)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	return stats, nil
+}
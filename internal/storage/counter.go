@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"log"
+)
+
+// ReserveCounterRange reserves size values of counter of short codes and returns the first of them.
+// Reserved values are never returned again, also after restart
+func (ms *dataStorage) ReserveCounterRange(ctx context.Context, size uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	first := ms.shortCodeCounter + 1
+	ms.shortCodeCounter += size
+	log.Printf("Reserve counter range in storage. First:%d|Last:%d\n", first, ms.shortCodeCounter)
+	if err := ms.appendToJournal(counterRecord(ms.shortCodeCounter)); err != nil {
+		return 0, err
+	}
+	return first, nil
+}
+
+func (dbs *databaseStorage) ReserveCounterRange(ctx context.Context, size uint64) (uint64, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	var last int64
+	err := dbs.pool.QueryRow(ctx, "UPDATE short_code_counter SET value = value + $1 RETURNING value", int64(size)).
+		Scan(&last)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	log.Printf("Reserve counter range in database. Last:%d\n", last)
+	return uint64(last) - size + 1, nil
+}
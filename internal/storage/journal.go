@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// File of dataStorage is a journal in JSON lines format. Every change of storage appends records to the end
+// of journal, and loadItems replays them. When journal grows, it is compacted: current state of storage
+// is written as snapshot to temporary file, which replaces journal.
+
+const (
+	journalOpAdd      = "add"
+	journalOpDelete   = "delete"
+	journalOpRestore  = "restore"
+	journalOpHistory  = "history"
+	journalOpClick    = "click"
+	journalOpAPIKey   = "api_key"
+	journalOpUser     = "user"
+	journalOpMerge    = "merge_history"
+	journalOpTransfer = "transfer"
+	// journalOpWorkspace creates workspace, journalOpMember sets or removes member of workspace
+	// and journalOpWorkspaceItems links short URLs to workspace
+	journalOpWorkspace      = "workspace"
+	journalOpMember         = "member"
+	journalOpWorkspaceItems = "workspace_items"
+	journalOpCounter        = "counter"
+	journalOpDailyClicks    = "daily_clicks"
+	journalOpRollUpClicks   = "roll_up_clicks"
+)
+
+// maxJournalLineSize limits size of one line of storage file. Files of previous versions of service keep
+// all URLs in one line
+const maxJournalLineSize = 64 * 1024 * 1024
+
+// ErrBrokenStorageFile is returned if storage file can't be loaded without loss of data
+var ErrBrokenStorageFile = errors.New("storage: broken storage file")
+
+var errLegacyFileTruncated = errors.New("storage file of previous version is truncated")
+
+// defaultCompactionThreshold is the number of records appended after last compaction which triggers new compaction
+const defaultCompactionThreshold = 1000
+
+type journalRecord struct {
+	Op          string      `json:"op"`
+	ShortURL    string      `json:"short_url"`
+	ShortURLs   []string    `json:"short_urls,omitempty"`
+	OrigURL     string      `json:"original_url,omitempty"`
+	UserID      int64       `json:"user_id,omitempty"`
+	FromUserID  int64       `json:"from_user_id,omitempty"`
+	WorkspaceID int64       `json:"workspace_id,omitempty"`
+	Role        string      `json:"role,omitempty"`
+	ExpiresAt   *time.Time  `json:"expires_at,omitempty"`
+	Click       *ClickEvent `json:"click,omitempty"`
+	APIKey      *APIKey     `json:"api_key,omitempty"`
+	User        *User       `json:"user,omitempty"`
+	Workspace   *Workspace  `json:"workspace,omitempty"`
+	Counter     uint64      `json:"counter,omitempty"`
+	Date        string      `json:"date,omitempty"`
+	Clicks      int         `json:"clicks,omitempty"`
+	Before      *time.Time  `json:"before,omitempty"`
+}
+
+type sourceFileManager struct {
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	// appended is the number of records written after last compaction
+	appended            int
+	compactionThreshold int
+}
+
+func openSourceFile(path string) (*sourceFileManager, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &sourceFileManager{
+		path:                path,
+		file:                file,
+		encoder:             json.NewEncoder(file),
+		compactionThreshold: defaultCompactionThreshold,
+	}, nil
+}
+
+func addRecord(id string, value string, expiresAt time.Time) journalRecord {
+	rec := journalRecord{Op: journalOpAdd, ShortURL: value, OrigURL: id}
+	if !expiresAt.IsZero() {
+		rec.ExpiresAt = &expiresAt
+	}
+	return rec
+}
+
+func deleteRecord(value string) journalRecord {
+	return journalRecord{Op: journalOpDelete, ShortURL: value}
+}
+
+// restoreRecord clears deleted flag of short URL
+func restoreRecord(value string) journalRecord {
+	return journalRecord{Op: journalOpRestore, ShortURL: value}
+}
+
+func historyRecord(id string, value string, userID int64) journalRecord {
+	return journalRecord{Op: journalOpHistory, ShortURL: value, OrigURL: id, UserID: userID}
+}
+
+func clickRecord(event ClickEvent) journalRecord {
+	return journalRecord{Op: journalOpClick, ShortURL: event.ShortURL, Click: &event}
+}
+
+// dailyClicksRecord adds number of clicks to counter of day
+func dailyClicksRecord(shortURL string, date string, clicks int) journalRecord {
+	return journalRecord{Op: journalOpDailyClicks, ShortURL: shortURL, Date: date, Clicks: clicks}
+}
+
+// rollUpClicksRecord moves click events made before given time to daily counters
+func rollUpClicksRecord(before time.Time) journalRecord {
+	return journalRecord{Op: journalOpRollUpClicks, Before: &before}
+}
+
+// apiKeyRecord stores whole state of key, so revocation is journaled as the same record with revocation time
+func apiKeyRecord(key APIKey) journalRecord {
+	return journalRecord{Op: journalOpAPIKey, APIKey: &key}
+}
+
+func userRecord(user User) journalRecord {
+	return journalRecord{Op: journalOpUser, User: &user}
+}
+
+// mergeHistoryRecord moves history of user FromUserID to history of user UserID
+func mergeHistoryRecord(fromUserID int64, toUserID int64) journalRecord {
+	return journalRecord{Op: journalOpMerge, UserID: toUserID, FromUserID: fromUserID}
+}
+
+// transferRecord moves short URLs from history of user FromUserID to history of user UserID
+func transferRecord(shortURLs []string, fromUserID int64, toUserID int64) journalRecord {
+	return journalRecord{Op: journalOpTransfer, ShortURLs: shortURLs, UserID: toUserID, FromUserID: fromUserID}
+}
+
+func workspaceRecord(workspace Workspace) journalRecord {
+	return journalRecord{Op: journalOpWorkspace, Workspace: &workspace}
+}
+
+// memberRecord sets role of member of workspace. Empty role removes member
+func memberRecord(workspaceID int64, userID int64, role string) journalRecord {
+	return journalRecord{Op: journalOpMember, WorkspaceID: workspaceID, UserID: userID, Role: role}
+}
+
+func workspaceItemsRecord(workspaceID int64, shortURLs []string) journalRecord {
+	return journalRecord{Op: journalOpWorkspaceItems, WorkspaceID: workspaceID, ShortURLs: shortURLs}
+}
+
+// counterRecord sets last reserved value of counter of short codes
+func counterRecord(counter uint64) journalRecord {
+	return journalRecord{Op: journalOpCounter, Counter: counter}
+}
+
+// appendToJournal writes records to the end of journal and compacts it if needed. Caller must hold write lock
+func (ms *dataStorage) appendToJournal(records ...journalRecord) error {
+	if ms.sfm == nil {
+		return nil
+	}
+	for _, rec := range records {
+		if err := ms.sfm.encoder.Encode(&rec); err != nil {
+			log.Printf("Error processing \"Encode\" journal record. Error message:%s", err.Error())
+			return err
+		}
+	}
+	ms.sfm.appended += len(records)
+	if ms.sfm.appended >= ms.sfm.compactionThreshold {
+		return ms.compact()
+	}
+	return nil
+}
+
+// applyRecord changes maps according to journal record. Caller must hold write lock
+func (ms *dataStorage) applyRecord(rec journalRecord) {
+	switch rec.Op {
+	case journalOpAdd:
+		ms.setItem(rec.OrigURL, rec.ShortURL)
+		if _, ok := ms.deletedURLs[rec.ShortURL]; !ok {
+			ms.deletedURLs[rec.ShortURL] = false
+		}
+		if rec.ExpiresAt != nil {
+			ms.expirations[rec.ShortURL] = *rec.ExpiresAt
+		}
+	case journalOpDelete:
+		ms.deletedURLs[rec.ShortURL] = true
+	case journalOpRestore:
+		ms.deletedURLs[rec.ShortURL] = false
+	case journalOpHistory:
+		ms.addItemUserHistory(rec.OrigURL, rec.ShortURL, rec.UserID)
+	case journalOpClick:
+		if rec.Click != nil {
+			event := *rec.Click
+			event.ShortURL = rec.ShortURL
+			ms.clickEvents[rec.ShortURL] = append(ms.clickEvents[rec.ShortURL], event)
+		}
+	case journalOpDailyClicks:
+		ms.addDailyClicks(rec.ShortURL, rec.Date, rec.Clicks)
+	case journalOpRollUpClicks:
+		if rec.Before != nil {
+			ms.rollUpClicks(*rec.Before)
+		}
+	case journalOpAPIKey:
+		if rec.APIKey != nil {
+			if key, ok := ms.apiKeys[rec.APIKey.ID]; ok {
+				key.RevokedAt = rec.APIKey.RevokedAt
+			} else {
+				ms.addAPIKey(*rec.APIKey)
+			}
+		}
+	case journalOpUser:
+		if rec.User != nil {
+			ms.setUser(*rec.User)
+		}
+	case journalOpMerge:
+		ms.mergeUserHistory(rec.FromUserID, rec.UserID)
+	case journalOpTransfer:
+		ms.transferItems(rec.ShortURLs, rec.FromUserID, rec.UserID)
+	case journalOpWorkspace:
+		if rec.Workspace != nil {
+			ms.setWorkspace(*rec.Workspace)
+		}
+	case journalOpMember:
+		ms.setWorkspaceMember(rec.WorkspaceID, rec.UserID, rec.Role)
+	case journalOpWorkspaceItems:
+		ms.addWorkspaceItems(rec.WorkspaceID, rec.ShortURLs)
+	case journalOpCounter:
+		if rec.Counter > ms.shortCodeCounter {
+			ms.shortCodeCounter = rec.Counter
+		}
+	default:
+		log.Printf("Unknown journal record. Operation:%s\n", rec.Op)
+	}
+}
+
+// snapshotRecords returns minimal set of records which restores current state of storage. Caller must hold lock
+func (ms *dataStorage) snapshotRecords() []journalRecord {
+	var records []journalRecord
+	for id, value := range ms.storage {
+		records = append(records, addRecord(id, value, ms.expirations[value]))
+	}
+	for value, deleted := range ms.deletedURLs {
+		if deleted {
+			records = append(records, deleteRecord(value))
+		}
+	}
+	for userID, history := range ms.userHistoryStorage {
+		for _, conv := range history {
+			records = append(records, historyRecord(conv.OrigURL, conv.ShortURL, userID))
+		}
+	}
+	for shortURL, daily := range ms.clicks {
+		for date, clicks := range daily {
+			records = append(records, dailyClicksRecord(shortURL, date, clicks))
+		}
+	}
+	for _, events := range ms.clickEvents {
+		for _, event := range events {
+			records = append(records, clickRecord(event))
+		}
+	}
+	for _, key := range ms.apiKeys {
+		records = append(records, apiKeyRecord(*key))
+	}
+	for _, user := range ms.users {
+		records = append(records, userRecord(*user))
+	}
+	for _, workspace := range ms.workspaces {
+		records = append(records, workspaceRecord(*workspace))
+	}
+	for workspaceID, members := range ms.workspaceMembers {
+		for userID, role := range members {
+			records = append(records, memberRecord(workspaceID, userID, role))
+		}
+	}
+	for workspaceID, shortURLs := range ms.workspaceURLs {
+		records = append(records, workspaceItemsRecord(workspaceID, shortURLs))
+	}
+	if ms.shortCodeCounter > 0 {
+		records = append(records, counterRecord(ms.shortCodeCounter))
+	}
+	return records
+}
+
+// compact replaces journal with snapshot of current state. Snapshot is written to temporary file first,
+// so journal stays consistent if process dies during compaction. Caller must hold write lock
+func (ms *dataStorage) compact() error {
+	log.Printf("Compacting storage journal. Path:%s\n", ms.sfm.path)
+	tmpPath := ms.sfm.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		log.Printf("Error creating snapshot file. Error message:%s", err.Error())
+		return err
+	}
+	encoder := json.NewEncoder(tmpFile)
+	for _, rec := range ms.snapshotRecords() {
+		if err := encoder.Encode(&rec); err != nil {
+			log.Printf("Error processing \"Encode\" snapshot record. Error message:%s", err.Error())
+			tmpFile.Close()
+			return err
+		}
+	}
+	if err := tmpFile.Sync(); err != nil {
+		log.Printf("Error processing \"Sync\" of snapshot. Error message:%s", err.Error())
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, ms.sfm.path); err != nil {
+		log.Printf("Error replacing journal with snapshot. Error message:%s", err.Error())
+		return err
+	}
+	if err := ms.sfm.file.Close(); err != nil {
+		log.Printf("Error closing old journal. Error message:%s", err.Error())
+	}
+	sfm, err := openSourceFile(ms.sfm.path)
+	if err != nil {
+		log.Printf("Cannot open data file. Path:%s\n", ms.sfm.path)
+		return err
+	}
+	sfm.compactionThreshold = ms.sfm.compactionThreshold
+	ms.sfm = sfm
+	return nil
+}
+
+// loadItems replays journal line by line. Broken lines are skipped, so one damaged record doesn't lose
+// records after it. Broken last line without line feed is a write interrupted by process death, it is cut off.
+// Files written by previous versions of service contain JSON dumps of maps, they are converted to journal.
+// If conversion fails, error is returned and file is left untouched
+func (ms *dataStorage) loadItems() error {
+	log.Printf("Loading storage items\n")
+	if ms.sfm == nil {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	info, err := ms.sfm.file.Stat()
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(ms.sfm.file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxJournalLineSize)
+	// offset is the position of the beginning of current line
+	var offset int64
+	lineNumber := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineNumber++
+		lineStart := offset
+		offset += int64(len(line)) + 1
+		terminated := offset <= info.Size()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if lineNumber == 1 && isLegacyFirstLine(line) {
+			if err := ms.loadLegacyItems(line, scanner); err != nil {
+				log.Printf("Cannot convert storage file to journal. Error message:%s\n", err.Error())
+				return fmt.Errorf("%w: %s", ErrBrokenStorageFile, err.Error())
+			}
+			ms.rebuildIndex()
+			return ms.compact()
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Op == "" {
+			if !terminated {
+				log.Printf("Cutting off broken end of journal. Line:%d\n", lineNumber)
+				return ms.sfm.file.Truncate(lineStart)
+			}
+			log.Printf("Skipping broken journal record. Line:%d\n", lineNumber)
+			continue
+		}
+		ms.applyRecord(rec)
+		ms.sfm.appended++
+		if !terminated {
+			// Next records must not be appended to the same line
+			if _, err := ms.sfm.file.Write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error loading items from storage. Error message:%s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+// isLegacyFirstLine reports whether line is the first line of file of previous versions of service.
+// Such files start with JSON object of URLs, which has no "op" key
+func isLegacyFirstLine(line []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["op"]
+	return !ok
+}
+
+func (ms *dataStorage) loadLegacyItems(first []byte, scanner *bufio.Scanner) error {
+	log.Printf("Converting storage file to journal\n")
+	if err := json.Unmarshal(first, &ms.storage); err != nil {
+		return err
+	}
+	if !scanner.Scan() {
+		return errLegacyFileTruncated
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &ms.deletedURLs); err != nil {
+		return err
+	}
+	if !scanner.Scan() {
+		return errLegacyFileTruncated
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &ms.userHistoryStorage); err != nil {
+		return err
+	}
+	for userID := range ms.userHistoryStorage {
+		ms.noteUserID(userID)
+	}
+	// Expirations were added to file format later, files without them are valid
+	if scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &ms.expirations); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations of database schema are SQL files named as <version>_<name>.up.sql and <version>_<name>.down.sql.
+// Applied versions are recorded in schema_migrations table.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key of advisory lock, which prevents replicas from applying migrations concurrently
+const migrationLockID = 7264011
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus describes state of database schema
+type MigrationStatus struct {
+	Current int
+	Latest  int
+}
+
+// MigrateUp applies all not applied migrations
+func MigrateUp(ctx context.Context, source string) error {
+	return withMigrationPool(ctx, source, func(conn *pgxpool.Conn, migrations []migration) error {
+		return migrateUp(ctx, conn, migrations)
+	})
+}
+
+// MigrateDown rolls back given number of last applied migrations
+func MigrateDown(ctx context.Context, source string, steps int) error {
+	return withMigrationPool(ctx, source, func(conn *pgxpool.Conn, migrations []migration) error {
+		return migrateDown(ctx, conn, migrations, steps)
+	})
+}
+
+// GetMigrationStatus returns current and latest versions of database schema
+func GetMigrationStatus(ctx context.Context, source string) (MigrationStatus, error) {
+	var status MigrationStatus
+	err := withMigrationPool(ctx, source, func(conn *pgxpool.Conn, migrations []migration) error {
+		current, err := currentSchemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		status.Current = current
+		if len(migrations) > 0 {
+			status.Latest = migrations[len(migrations)-1].version
+		}
+		return nil
+	})
+	return status, err
+}
+
+func withMigrationPool(ctx context.Context, source string, fn func(conn *pgxpool.Conn, migrations []migration) error) error {
+	dbpool, err := pgxpool.Connect(ctx, source)
+	if err != nil {
+		log.Printf("Cannot connect to database")
+		return err
+	}
+	defer dbpool.Close()
+	return withMigrationLock(ctx, dbpool, fn)
+}
+
+// withMigrationLock runs fn on single connection holding advisory lock
+func withMigrationLock(ctx context.Context, dbpool *pgxpool.Pool, fn func(conn *pgxpool.Conn, migrations []migration) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		log.Printf("Cannot load migrations. Error message:%s\n", err.Error())
+		return err
+	}
+	conn, err := dbpool.Acquire(ctx)
+	if err != nil {
+		log.Printf("Cannot acquire connection. Error message:%s\n", err.Error())
+		return err
+	}
+	defer conn.Release()
+
+	// Advisory lock belongs to session, so it is taken and released on the same connection
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		log.Printf("Cannot take migration lock. Error message:%s\n", err.Error())
+		return err
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			log.Printf("Cannot release migration lock. Error message:%s\n", err.Error())
+		}
+	}()
+
+	queryCreateMigrations := "CREATE TABLE IF NOT EXISTS schema_migrations " +
+		"(version integer NOT NULL PRIMARY KEY, name text NOT NULL, " +
+		"applied_at timestamp with time zone NOT NULL DEFAULT now())"
+	if _, err := conn.Exec(ctx, queryCreateMigrations); err != nil {
+		log.Printf("Cannot create schema_migrations table")
+		return err
+	}
+	return fn(conn, migrations)
+}
+
+func currentSchemaVersion(ctx context.Context, conn *pgxpool.Conn) (int, error) {
+	var version int
+	err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	return version, nil
+}
+
+func migrateUp(ctx context.Context, conn *pgxpool.Conn, migrations []migration) error {
+	current, err := currentSchemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Printf("Apply migration. Version:%d|Name:%s\n", m.version, m.name)
+		err := conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+			return err
+		})
+		if err != nil {
+			log.Printf("Cannot apply migration. Version:%d|Error message:%s\n", m.version, err.Error())
+			return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func migrateDown(ctx context.Context, conn *pgxpool.Conn, migrations []migration, steps int) error {
+	current, err := currentSchemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.version > current {
+			continue
+		}
+		log.Printf("Roll back migration. Version:%d|Name:%s\n", m.version, m.name)
+		err := conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.version)
+			return err
+		})
+		if err != nil {
+			log.Printf("Cannot roll back migration. Version:%d|Error message:%s\n", m.version, err.Error())
+			return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// loadMigrations reads embedded migrations sorted by version
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", fileName)
+		}
+		baseName := strings.TrimSuffix(fileName, "."+direction+".sql")
+		parts := strings.SplitN(baseName, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration file %s has no version", fileName)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has invalid version: %w", fileName, err)
+		}
+		content, err := migrationFiles.ReadFile("migrations/" + fileName)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have up and down files", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
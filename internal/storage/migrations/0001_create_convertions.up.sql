@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS convertions (
+    short_url character varying(2048) NOT NULL PRIMARY KEY,
+    orig_url character varying(2048) NOT NULL,
+    deleted boolean
+);
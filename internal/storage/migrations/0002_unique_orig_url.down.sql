@@ -0,0 +1 @@
+DROP INDEX IF EXISTS convertions_orig_url_idx;
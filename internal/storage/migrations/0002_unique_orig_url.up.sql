@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS convertions_orig_url_idx ON convertions (orig_url);
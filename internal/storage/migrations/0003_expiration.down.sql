@@ -0,0 +1 @@
+ALTER TABLE convertions DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1 @@
+ALTER TABLE convertions ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS histories (
+    user_id integer NOT NULL PRIMARY KEY,
+    history text NOT NULL
+);
+
+INSERT INTO histories (user_id, history)
+SELECT u.user_id, string_agg(c.short_url || ' ' || c.orig_url, '|' ORDER BY u.added_at)
+FROM user_urls u JOIN convertions c ON c.short_url = u.short_url
+GROUP BY u.user_id
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS user_urls;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS user_urls (
+    user_id integer NOT NULL,
+    short_url character varying(2048) NOT NULL REFERENCES convertions (short_url) ON DELETE CASCADE,
+    added_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, short_url)
+);
+
+-- Legacy histories table kept whole history of user in one text column as "short orig|short orig".
+-- Short URLs never contain spaces and "|", so first word of every pair is short URL.
+-- Pairs broken by such symbols in original URLs are filtered by join with convertions.
+DO $$
+BEGIN
+    IF to_regclass('histories') IS NOT NULL THEN
+        INSERT INTO user_urls (user_id, short_url)
+        SELECT DISTINCT h.user_id, c.short_url FROM histories h
+        CROSS JOIN LATERAL unnest(string_to_array(h.history, '|')) AS p(pair)
+        JOIN convertions c ON c.short_url = split_part(p.pair, ' ', 1)
+        ON CONFLICT DO NOTHING;
+        DROP TABLE histories;
+    END IF;
+END $$;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS clicks (
+    id bigserial PRIMARY KEY,
+    short_url character varying(2048) NOT NULL REFERENCES convertions (short_url) ON DELETE CASCADE,
+    clicked_at timestamp with time zone NOT NULL,
+    referrer text NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    country character varying(2) NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS clicks_short_url_clicked_at_idx ON clicks (short_url, clicked_at);
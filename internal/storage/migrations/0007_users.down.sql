@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS users;
+
+ALTER TABLE api_keys ALTER COLUMN user_id TYPE integer;
+ALTER TABLE user_urls ALTER COLUMN user_id TYPE integer;
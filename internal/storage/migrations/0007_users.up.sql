@@ -0,0 +1,17 @@
+ALTER TABLE user_urls ALTER COLUMN user_id TYPE bigint;
+ALTER TABLE api_keys ALTER COLUMN user_id TYPE bigint;
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial PRIMARY KEY,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_seen_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- Users created before registry got random IDs. They are registered with the same IDs,
+-- and sequence starts after the greatest of them, so new IDs never repeat old ones
+INSERT INTO users (id)
+SELECT user_id FROM user_urls
+UNION
+SELECT user_id FROM api_keys
+ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('users', 'id'), COALESCE((SELECT MAX(id) FROM users), 0) + 1, false);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS users_login_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS password_hash;
+ALTER TABLE users DROP COLUMN IF EXISTS login;
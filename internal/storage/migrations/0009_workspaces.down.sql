@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS workspace_urls;
+DROP TABLE IF EXISTS workspace_members;
+DROP TABLE IF EXISTS workspaces;
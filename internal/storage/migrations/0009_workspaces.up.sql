@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS workspaces (
+    id bigserial PRIMARY KEY,
+    name character varying(128) NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id bigint NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    user_id bigint NOT NULL,
+    role character varying(16) NOT NULL,
+    PRIMARY KEY (workspace_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS workspace_members_user_id_idx ON workspace_members (user_id);
+
+CREATE TABLE IF NOT EXISTS workspace_urls (
+    workspace_id bigint NOT NULL REFERENCES workspaces (id) ON DELETE CASCADE,
+    short_url character varying(2048) NOT NULL REFERENCES convertions (short_url) ON DELETE CASCADE,
+    added_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (workspace_id, short_url)
+);
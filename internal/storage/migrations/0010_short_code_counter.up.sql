@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS short_code_counter (
+    id boolean PRIMARY KEY DEFAULT true CHECK (id),
+    value bigint NOT NULL
+);
+INSERT INTO short_code_counter (id, value) VALUES (true, 0) ON CONFLICT DO NOTHING;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS click_daily (
+    short_url character varying(2048) NOT NULL REFERENCES convertions (short_url) ON DELETE CASCADE,
+    day date NOT NULL,
+    clicks bigint NOT NULL,
+    PRIMARY KEY (short_url, day)
+);
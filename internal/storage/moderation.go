@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Link describes short URL with its moderation state. ExpiresAt is nil if short URL never expires
+type Link struct {
+	ShortURL  string     `json:"short_url"`
+	OrigURL   string     `json:"original_url"`
+	Deleted   bool       `json:"deleted"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// SearchItems returns up to limit links, whose original or short URL contains query. Case is ignored.
+// Links are ordered by short URL
+func (ms *dataStorage) SearchItems(ctx context.Context, query string, limit int) ([]Link, error) {
+	log.Printf("Search items in storage. Query:%s|Limit:%d\n", query, limit)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	query = strings.ToLower(query)
+	var links []Link
+	for id, value := range ms.storage {
+		if !strings.Contains(strings.ToLower(id), query) && !strings.Contains(strings.ToLower(value), query) {
+			continue
+		}
+		link := Link{ShortURL: value, OrigURL: id, Deleted: ms.deletedURLs[value]}
+		if expiresAt, ok := ms.expirations[value]; ok {
+			link.ExpiresAt = &expiresAt
+		}
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].ShortURL < links[j].ShortURL })
+	if len(links) > limit {
+		links = links[:limit]
+	}
+	return links, nil
+}
+
+// RestoreBatchItems clears deleted flag of short URLs. It is the reverse of MarkDeleteBatchItems
+func (ms *dataStorage) RestoreBatchItems(ctx context.Context, ids []string) error {
+	log.Printf("Restore batch items in storage: %s.\n", ids)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var records []journalRecord
+	for _, id := range ids {
+		if _, ok := ms.findItem(id); !ok {
+			continue
+		}
+		ms.deletedURLs[id] = false
+		records = append(records, restoreRecord(id))
+	}
+	return ms.appendToJournal(records...)
+}
+
+// GetUserLinks returns links from history of user with their moderation state in order of history.
+// ErrEmptyResult is returned if user has no links
+func (ms *dataStorage) GetUserLinks(ctx context.Context, userID int64) ([]Link, error) {
+	log.Printf("Get user links. User ID:%d\n", userID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	history, ok := ms.userHistoryStorage[userID]
+	if !ok || len(history) == 0 {
+		return nil, ErrEmptyResult
+	}
+	links := make([]Link, 0, len(history))
+	for _, conv := range history {
+		link := Link{ShortURL: conv.ShortURL, OrigURL: conv.OrigURL, Deleted: ms.deletedURLs[conv.ShortURL]}
+		if expiresAt, ok := ms.expirations[conv.ShortURL]; ok {
+			link.ExpiresAt = &expiresAt
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (dbs *databaseStorage) SearchItems(ctx context.Context, query string, limit int) ([]Link, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Search items in database. Query:%s|Limit:%d\n", query, limit)
+	pattern := "%" + escapeLikePattern(query) + "%"
+	rows, err := dbs.pool.Query(ctx,
+		`SELECT short_url, orig_url, COALESCE(deleted, false), expires_at FROM convertions
+		WHERE orig_url ILIKE $1 OR short_url ILIKE $1 ORDER BY short_url LIMIT $2`,
+		pattern, limit)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		var link Link
+		if err := rows.Scan(&link.ShortURL, &link.OrigURL, &link.Deleted, &link.ExpiresAt); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (dbs *databaseStorage) RestoreBatchItems(ctx context.Context, ids []string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Restore batch items in database: %s.\n", ids)
+	_, err := dbs.pool.Exec(ctx, "UPDATE convertions SET deleted = $1 WHERE short_url = ANY($2)", false, ids)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+	}
+	return err
+}
+
+func (dbs *databaseStorage) GetUserLinks(ctx context.Context, userID int64) ([]Link, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Get user links. User ID:%d\n", userID)
+	rows, err := dbs.pool.Query(ctx,
+		`SELECT c.short_url, c.orig_url, COALESCE(c.deleted, false), c.expires_at FROM user_urls u
+		JOIN convertions c ON c.short_url = u.short_url WHERE u.user_id = $1 ORDER BY u.added_at`,
+		userID)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []Link
+	for rows.Next() {
+		var link Link
+		if err := rows.Scan(&link.ShortURL, &link.OrigURL, &link.Deleted, &link.ExpiresAt); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, ErrEmptyResult
+	}
+	return links, nil
+}
+
+// escapeLikePattern escapes special symbols of LIKE patterns, so query is matched literally
+func escapeLikePattern(query string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+}
@@ -2,8 +2,6 @@ package storage
 
 import (
 	"context"
-	"database/sql/driver"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgconn"
@@ -11,195 +9,345 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
-	"os"
-	"strings"
+	"sync"
 	"time"
 )
 
 type Repository interface {
-	AddItem(id string, value string, userID int) error
-	AddBatchItems(ids []string, values []string, userID int) error
-	GetItem(value string) (*ItemResult, error)
-	GetItemByID(ID string) (*ItemResult, error)
-	GetUserHistory(userID int) (History, error)
-	MarkDeleteBatchItems(ids []string) error
+	AddItem(ctx context.Context, id string, value string, expiresAt time.Time, userID int64) error
+	AddBatchItems(ctx context.Context, ids []string, values []string, expiresAt []time.Time, userID int64) ([]BatchItemResult, error)
+	GetItem(ctx context.Context, value string) (*ItemResult, error)
+	GetItemByID(ctx context.Context, ID string) (*ItemResult, error)
+	GetUserHistory(ctx context.Context, userID int64) (History, error)
+	MarkDeleteBatchItems(ctx context.Context, ids []string) error
+	MarkDeleteExpiredItems(ctx context.Context, now time.Time) (int, error)
+	RestoreBatchItems(ctx context.Context, ids []string) error
+	SearchItems(ctx context.Context, query string, limit int) ([]Link, error)
+	GetUserLinks(ctx context.Context, userID int64) ([]Link, error)
+	AddClicks(ctx context.Context, events []ClickEvent) error
+	RollUpClicks(ctx context.Context, before time.Time) error
+	GetClickStats(ctx context.Context, shortURL string) (*ClickStats, error)
+	CreateUser(ctx context.Context, now time.Time) (int64, error)
+	GetUser(ctx context.Context, userID int64) (*User, error)
+	TouchUser(ctx context.Context, userID int64, now time.Time) error
+	GetUserByLogin(ctx context.Context, login string) (*User, error)
+	SetUserCredentials(ctx context.Context, userID int64, login string, passwordHash string) error
+	MergeUserHistory(ctx context.Context, fromUserID int64, toUserID int64) error
+	TransferItems(ctx context.Context, shortURLs []string, fromUserID int64, toUserID int64) error
+	CreateWorkspace(ctx context.Context, name string, ownerID int64, ownerRole string, now time.Time) (*Workspace, error)
+	GetWorkspace(ctx context.Context, workspaceID int64) (*Workspace, error)
+	GetUserWorkspaces(ctx context.Context, userID int64) ([]WorkspaceMembership, error)
+	GetWorkspaceMembers(ctx context.Context, workspaceID int64) ([]WorkspaceMember, error)
+	GetWorkspaceRole(ctx context.Context, workspaceID int64, userID int64) (string, error)
+	SetWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, role string, ownerRole string) error
+	RemoveWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, ownerRole string) error
+	AddWorkspaceItems(ctx context.Context, workspaceID int64, shortURLs []string) error
+	GetWorkspaceHistory(ctx context.Context, workspaceID int64) (History, error)
+	GetWorkspaceItemRoles(ctx context.Context, shortURL string, userID int64) ([]string, error)
+	AddAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, revokedAt time.Time) error
+	ReserveCounterRange(ctx context.Context, size uint64) (uint64, error)
 	Close() error
 }
 
-type sourceFileManager struct {
-	file    *os.File
-	encoder *json.Encoder
-	decoder *json.Decoder
-}
-
 type URLConversion struct {
 	ShortURL string `json:"short_url"`
 	OrigURL  string `json:"original_url"`
 }
 
+// dataStorage keeps items in memory and optionally in file. All maps are guarded by mu,
+// so storage may be used from concurrent handlers and workers. Recent clicks are kept as events,
+// older ones as counters by short URL and day
 type dataStorage struct {
-	userHistoryStorage map[int][]URLConversion
+	mu                 sync.RWMutex
+	userHistoryStorage map[int64][]URLConversion
 	storage            map[string]string
+	shortURLIndex      map[string]string
 	deletedURLs        map[string]bool
-	sfm                *sourceFileManager
+	expirations        map[string]time.Time
+	clickEvents        map[string][]ClickEvent
+	clicks             map[string]map[string]int
+	apiKeys            map[string]*APIKey
+	apiKeyHashes       map[string]string
+	users              map[int64]*User
+	userLogins         map[string]int64
+	workspaces         map[int64]*Workspace
+	workspaceMembers   map[int64]map[int64]string
+	workspaceURLs      map[int64][]string
+	// lastUserID is the greatest user ID known to storage
+	lastUserID int64
+	// lastWorkspaceID is the greatest workspace ID known to storage
+	lastWorkspaceID int64
+	// shortCodeCounter is the last reserved value of counter of short codes
+	shortCodeCounter uint64
+	sfm              *sourceFileManager
 }
 
 type History []URLConversion
 
-// ItemResult returning results of query in storage
+// ItemResult returning results of query in storage. Zero ExpiresAt means that item never expires
 type ItemResult struct {
 	Item            string
 	HaveDeletedFlag bool
+	ExpiresAt       time.Time
+}
+
+// BatchItemResult describes result of adding one item of batch. If item already existed,
+// Created is false and Item contains short URL, which was stored before
+type BatchItemResult struct {
+	Item    string
+	Created bool
 }
 
 var ErrEmptyResult = errors.New("storage: empty result")
 var ErrAlreadyExist = errors.New("storage: already exist")
+var ErrShortURLCollision = errors.New("storage: short URL is taken by another URL")
 
+// NewDataStorage returns storage in memory, or in file if source is set. If file can't be loaded,
+// error is logged and storage in memory is returned, so file is left untouched
 func NewDataStorage(source string) *dataStorage {
+	ds, err := OpenDataStorage(source)
+	if err != nil {
+		return newEmptyDataStorage(nil)
+	}
+	return ds
+}
+
+// OpenDataStorage returns storage in memory, or in file if source is set. Error is returned
+// if file can't be opened or loaded
+func OpenDataStorage(source string) (*dataStorage, error) {
 	if source == "" {
-		return &dataStorage{make(map[int][]URLConversion),
-			make(map[string]string),
-			make(map[string]bool),
-			nil}
+		return newEmptyDataStorage(nil), nil
 	}
-	file, err := os.OpenFile(source, os.O_RDWR|os.O_CREATE, 0777)
+	sfm, err := openSourceFile(source)
 	if err != nil {
 		log.Printf("Cannot open data file. Path:%s\n", source)
-		return &dataStorage{make(map[int][]URLConversion),
-			make(map[string]string),
-			make(map[string]bool),
-			nil}
-	}
-	sfm := sourceFileManager{
-		file:    file,
-		encoder: json.NewEncoder(file),
-		decoder: json.NewDecoder(file)}
-	ds := dataStorage{make(map[int][]URLConversion),
-		map[string]string{},
-		make(map[string]bool),
-		&sfm}
+		return nil, err
+	}
+	ds := newEmptyDataStorage(sfm)
 	if err := ds.loadItems(); err != nil {
-		return &ds
+		log.Printf("Cannot load data file. Path:%s\n", source)
+		sfm.file.Close()
+		return nil, err
 	}
-	return &ds
+	return ds, nil
 }
 
-func (ms *dataStorage) AddItem(id string, value string, userID int) error {
-	log.Printf("Add item to storage. Short URL:%s|Original URL:%s|User ID:%d\n", value, id, userID)
-	if _, ok := ms.storage[id]; ok {
-		log.Println("Result: conflict. Item already exist")
-		err := ErrAlreadyExist
-		return err
+func newEmptyDataStorage(sfm *sourceFileManager) *dataStorage {
+	return &dataStorage{
+		userHistoryStorage: make(map[int64][]URLConversion),
+		storage:            make(map[string]string),
+		shortURLIndex:      make(map[string]string),
+		deletedURLs:        make(map[string]bool),
+		expirations:        make(map[string]time.Time),
+		clickEvents:        make(map[string][]ClickEvent),
+		clicks:             make(map[string]map[string]int),
+		apiKeys:            make(map[string]*APIKey),
+		apiKeyHashes:       make(map[string]string),
+		users:              make(map[int64]*User),
+		userLogins:         make(map[string]int64),
+		workspaces:         make(map[int64]*Workspace),
+		workspaceMembers:   make(map[int64]map[int64]string),
+		workspaceURLs:      make(map[int64][]string),
+		sfm:                sfm,
 	}
-	ms.storage[id] = value
-	ms.deletedURLs[value] = false
-	ms.addItemUserHistory(id, value, userID)
-	if ms.sfm != nil {
-		if err := ms.writeToFile(); err != nil {
-			return err
-		}
-	}
-	return nil
 }
 
-func (ms *dataStorage) writeToFile() error {
-	if err := ms.sfm.file.Truncate(0); err != nil {
-		log.Printf("Error processing \"Truncate\". Error message:%s", err.Error())
+func (ms *dataStorage) AddItem(ctx context.Context, id string, value string, expiresAt time.Time, userID int64) error {
+	log.Printf("Add item to storage. Short URL:%s|Original URL:%s|User ID:%d\n", value, id, userID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
 		return err
 	}
-	if _, err := ms.sfm.file.Seek(0, 0); err != nil {
-		log.Printf("Error processing \"Seek\". Error message:%s", err.Error())
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if err := ms.addItem(id, value, expiresAt, userID); err != nil {
 		return err
 	}
-	if err := ms.sfm.encoder.Encode(&ms.storage); err != nil {
-		log.Printf("Error processing \"Encode\" URLs convertions. Error message:%s", err.Error())
+	return ms.appendToJournal(addRecord(id, value, expiresAt), historyRecord(id, value, userID))
+}
+
+// addItem adds item to maps. Caller must hold write lock
+func (ms *dataStorage) addItem(id string, value string, expiresAt time.Time, userID int64) error {
+	if _, ok := ms.storage[id]; ok {
+		log.Println("Result: conflict. Item already exist")
+		err := ErrAlreadyExist
 		return err
 	}
-	if err := ms.sfm.encoder.Encode(&ms.deletedURLs); err != nil {
-		log.Printf("Error processing \"Encode\" deleted URLs. Error message:%s", err.Error())
+	if _, ok := ms.findItem(value); ok {
+		log.Println("Result: conflict. Short URL is taken by another item")
+		err := ErrShortURLCollision
 		return err
 	}
-	if err := ms.sfm.encoder.Encode(&ms.userHistoryStorage); err != nil {
-		log.Printf("Error processing \"Encode\" user history. Error message:%s", err.Error())
-		return err
+	ms.setItem(id, value)
+	ms.deletedURLs[value] = false
+	if !expiresAt.IsZero() {
+		ms.expirations[value] = expiresAt
 	}
+	ms.addItemUserHistory(id, value, userID)
 	return nil
 }
 
-func (ms *dataStorage) AddBatchItems(ids []string, values []string, userID int) error {
+// AddBatchItems adds all new items of batch or none of them. Items which already exist are reported in results
+func (ms *dataStorage) AddBatchItems(ctx context.Context, ids []string, values []string, expiresAt []time.Time, userID int64) ([]BatchItemResult, error) {
 	log.Printf("Add batch items to storage.\n")
-	if len(ids) != len(values) {
+	if len(ids) != len(values) || len(ids) != len(expiresAt) {
 		err := errors.New("number of id and values is not equal")
 		log.Printf("Error adding batch items. Error message:%s\n", err.Error())
-		return err
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Check all items before changing storage, so batch is added atomically
+	results := make([]BatchItemResult, len(ids))
+	addedInBatch := make(map[string]string)
+	takenInBatch := make(map[string]bool)
+	for i := 0; i < len(ids); i++ {
+		if existing, ok := ms.storage[ids[i]]; ok {
+			results[i] = BatchItemResult{existing, false}
+			continue
+		}
+		if existing, ok := addedInBatch[ids[i]]; ok {
+			results[i] = BatchItemResult{existing, false}
+			continue
+		}
+		if _, ok := ms.findItem(values[i]); ok || takenInBatch[values[i]] {
+			log.Printf("Result: conflict. Short URL is taken by another item. Short URL:%s\n", values[i])
+			return nil, ErrShortURLCollision
+		}
+		addedInBatch[ids[i]] = values[i]
+		takenInBatch[values[i]] = true
+		results[i] = BatchItemResult{values[i], true}
 	}
+
+	var records []journalRecord
 	for i := 0; i < len(ids); i++ {
-		err := ms.AddItem(ids[i], values[i], userID)
-		if err != nil {
-			return err
+		if !results[i].Created {
+			continue
 		}
+		log.Printf("Add item to storage. Short URL:%s|Original URL:%s|User ID:%d\n", values[i], ids[i], userID)
+		if err := ms.addItem(ids[i], values[i], expiresAt[i], userID); err != nil {
+			return nil, err
+		}
+		records = append(records, addRecord(ids[i], values[i], expiresAt[i]), historyRecord(ids[i], values[i], userID))
 	}
-	return nil
+	if err := ms.appendToJournal(records...); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func (ms *dataStorage) MarkDeleteBatchItems(ids []string) error {
+func (ms *dataStorage) MarkDeleteBatchItems(ctx context.Context, ids []string) error {
 	log.Printf("Mark delete batch items in storage: %s.\n", ids)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var records []journalRecord
 	for _, id := range ids {
 		ms.deletedURLs[id] = true
+		records = append(records, deleteRecord(id))
 	}
-	if ms.sfm != nil {
-		if err := ms.writeToFile(); err != nil {
-			return err
+	return ms.appendToJournal(records...)
+}
+
+// MarkDeleteExpiredItems marks as deleted all items expired before now and returns number of marked items
+func (ms *dataStorage) MarkDeleteExpiredItems(ctx context.Context, now time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var records []journalRecord
+	for value, expiresAt := range ms.expirations {
+		if ms.deletedURLs[value] || expiresAt.After(now) {
+			continue
 		}
+		ms.deletedURLs[value] = true
+		records = append(records, deleteRecord(value))
 	}
-	return nil
+	if len(records) == 0 {
+		return 0, nil
+	}
+	log.Printf("Mark delete expired items in storage. Number of items:%d\n", len(records))
+	return len(records), ms.appendToJournal(records...)
 }
 
-func (ms *dataStorage) GetItem(value string) (*ItemResult, error) {
+func (ms *dataStorage) GetItem(ctx context.Context, value string) (*ItemResult, error) {
 	log.Printf("Get original URL by short URL. Short URL:%s\n", value)
-	for key, val := range ms.storage {
-		if val == value {
-			return &ItemResult{key, ms.deletedURLs[val]}, nil
-		}
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if key, ok := ms.findItem(value); ok {
+		return &ItemResult{key, ms.deletedURLs[value], ms.expirations[value]}, nil
 	}
 	err := ErrEmptyResult
 	log.Printf("Item not found. Error message:%s\n", err.Error())
 	return nil, err
 }
 
-func (ms *dataStorage) GetItemByID(ID string) (*ItemResult, error) {
+// findItem returns original URL for short URL. Caller must hold lock
+func (ms *dataStorage) findItem(value string) (string, bool) {
+	key, ok := ms.shortURLIndex[value]
+	return key, ok
+}
+
+// setItem stores conversion and keeps index of short URLs consistent with it. Caller must hold write lock
+func (ms *dataStorage) setItem(id string, value string) {
+	if oldValue, ok := ms.storage[id]; ok && oldValue != value {
+		delete(ms.shortURLIndex, oldValue)
+	}
+	ms.storage[id] = value
+	ms.shortURLIndex[value] = id
+}
+
+// rebuildIndex makes index of short URLs from scratch. Caller must hold write lock
+func (ms *dataStorage) rebuildIndex() {
+	ms.shortURLIndex = make(map[string]string, len(ms.storage))
+	for key, val := range ms.storage {
+		ms.shortURLIndex[val] = key
+	}
+}
+
+func (ms *dataStorage) GetItemByID(ctx context.Context, ID string) (*ItemResult, error) {
 	log.Printf("Get short URL by original URL. Original URL:%s\n", ID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
 	val, exist := ms.storage[ID]
 	if !exist {
 		err := ErrEmptyResult
 		log.Printf("Item not found. Error message:%s\n", err.Error())
 		return nil, err
 	}
-	return &ItemResult{val, ms.deletedURLs[val]}, nil
+	return &ItemResult{val, ms.deletedURLs[val], ms.expirations[val]}, nil
 }
 
-func (ms *dataStorage) loadItems() error {
-	log.Printf("Loading storage items\n")
-	if ms.sfm == nil {
-		return nil
-	}
-	if err := ms.sfm.decoder.Decode(&ms.storage); err != nil {
-		log.Printf("Error loading items from storage. Error message:%s\n", err.Error())
-		return err
-	}
-	if err := ms.sfm.decoder.Decode(&ms.deletedURLs); err != nil {
-		log.Printf("Error loading items from storage. Error message:%s\n", err.Error())
-		return err
-	}
-	if err := ms.sfm.decoder.Decode(&ms.userHistoryStorage); err != nil {
-		log.Printf("Error loading items from storage. Error message:%s\n", err.Error())
-		return err
-	}
-	return nil
-}
-
-func (ms *dataStorage) addItemUserHistory(id string, value string, userID int) {
+// addItemUserHistory adds item to user history. Caller must hold write lock
+func (ms *dataStorage) addItemUserHistory(id string, value string, userID int64) {
 	log.Printf("Add item to user history. Short URL:%s|Original URL:%s|User ID:%d\n", value, id, userID)
+	ms.noteUserID(userID)
 	history, ok := ms.userHistoryStorage[userID]
 	if ok {
 		found := false
@@ -220,49 +368,65 @@ func (ms *dataStorage) addItemUserHistory(id string, value string, userID int) {
 	ms.userHistoryStorage[userID] = append(ms.userHistoryStorage[userID], URLConversion{value, id})
 }
 
-func (ms *dataStorage) GetUserHistory(userID int) (History, error) {
+func (ms *dataStorage) GetUserHistory(ctx context.Context, userID int64) (History, error) {
 	log.Printf("Get user history. User ID:%d\n", userID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return make(History, 0), err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
 	history, ok := ms.userHistoryStorage[userID]
 	if !ok {
 		return make(History, 0), ErrEmptyResult
 	}
-	return history, nil
+	// Copy history, so caller can't change it without lock
+	historyCopy := make(History, len(history))
+	copy(historyCopy, history)
+	return historyCopy, nil
 }
 
 func (ms *dataStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
 	if ms.sfm != nil {
 		return ms.sfm.file.Close()
 	}
 	return nil
 }
 
+// origURLIndexName is the name of unique index which prevents shortening of the same URL twice
+const origURLIndexName = "convertions_orig_url_idx"
+
 type databaseStorage struct {
 	pool *pgxpool.Pool
+	// queryTimeout limits duration of every query in addition to deadline of request context
+	queryTimeout time.Duration
 }
 
-func NewDatabaseStorage(source string) (*databaseStorage, error) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-
+func NewDatabaseStorage(ctx context.Context, source string, queryTimeout time.Duration) (*databaseStorage, error) {
 	dbpool, err := pgxpool.Connect(ctx, source)
 	if err != nil {
 		log.Printf("Cannot connect to database")
 		return nil, err
 	}
 
-	queryCreateConv := "CREATE TABLE IF NOT EXISTS convertions " +
-		"(short_url character varying(2048) NOT NULL PRIMARY KEY, orig_url character varying(2048) NOT NULL, deleted boolean)"
-	if _, err := dbpool.Exec(ctx, queryCreateConv); err != nil {
-		log.Printf("Cannot create convertions table")
-		return nil, err
-	}
-	queryCreateHistories := "CREATE TABLE IF NOT EXISTS histories " +
-		"(user_id integer NOT NULL PRIMARY KEY, history text NOT NULL)"
-	if _, err := dbpool.Exec(ctx, queryCreateHistories); err != nil {
-		log.Printf("Cannot create histories table")
+	err = withMigrationLock(ctx, dbpool, func(conn *pgxpool.Conn, migrations []migration) error {
+		return migrateUp(ctx, conn, migrations)
+	})
+	if err != nil {
+		log.Printf("Cannot apply migrations")
+		dbpool.Close()
 		return nil, err
 	}
-	return &databaseStorage{dbpool}, nil
+	return &databaseStorage{dbpool, queryTimeout}, nil
+}
+
+// withQueryTimeout returns context of query, which is canceled with ctx or after query timeout
+func (dbs *databaseStorage) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dbs.queryTimeout)
 }
 
 func (dbs *databaseStorage) Close() error {
@@ -270,113 +434,178 @@ func (dbs *databaseStorage) Close() error {
 	return nil
 }
 
-func (dbs *databaseStorage) AddItem(id string, value string, userID int) error {
+func (dbs *databaseStorage) AddItem(ctx context.Context, id string, value string, expiresAt time.Time, userID int64) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
 	// Я рассматривал вариант, чтобы сделать ON CONFLICT DO UPDATE, но мне показалось,
 	// что логика будет менее очевидной. В итоге остановился на текущем варианте,
 	// тем более что на выбор предлагались оба варианта.
 	log.Printf("Add item to database. Short URL:%s|Original URL:%s|User ID:%d\n", value, id, userID)
-
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-	if _, err := dbs.pool.Exec(ctx,
-		"INSERT INTO convertions (short_url, orig_url, deleted) VALUES ($1, $2, $3)", value, id, false); err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == pgerrcode.UniqueViolation {
-				log.Println("Result: conflict. Item already exist")
-				err := ErrAlreadyExist
-				return err
-			}
-			log.Printf("Result: error. Error message:%s\n", err.Error())
-			return err
-		}
-		log.Printf("Result: error. Error message:%s\n", err.Error())
+	tx, err := dbs.pool.Begin(ctx)
+	if err != nil {
+		log.Printf("Cannot begin transaction. Error message:%s\n", err.Error())
 		return err
 	}
-	if err := dbs.addItemUserHistory(id, value, userID); err != nil {
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO convertions (short_url, orig_url, deleted, expires_at) VALUES ($1, $2, $3, $4)",
+		value, id, false, nullableTime(expiresAt)); err != nil {
+		return convertInsertError(err)
+	}
+	if err := addItemUserHistory(ctx, tx, value, userID); err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit(ctx)
 }
 
-func (dbs *databaseStorage) AddBatchItems(ids []string, values []string, userID int) error {
-	batch := &pgx.Batch{}
-	log.Printf("Add batch items to database.\n")
-	for i := 0; i < len(ids); i++ {
-		batch.Queue("INSERT INTO convertions (short_url, orig_url, deleted) VALUES ($1, $2, $3)", values[i], ids[i], false)
+// convertInsertError converts unique violations of convertions table to storage errors
+func convertInsertError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		if pgErr.ConstraintName == origURLIndexName {
+			log.Println("Result: conflict. Item already exist")
+			return ErrAlreadyExist
+		}
+		log.Println("Result: conflict. Short URL is taken by another item")
+		return ErrShortURLCollision
 	}
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-
-	batchRes := dbs.pool.SendBatch(ctx, batch)
-	defer batchRes.Close()
+	log.Printf("Result: error. Error message:%s\n", err.Error())
+	return err
+}
 
-	// Не совсем понял, нужно ли дополнять историю юзера в этом случае. Пока не делаю, т.к. некоторые вещи в этом не очевидны
+// AddBatchItems adds all new items of batch in one transaction. Items which already exist are reported in results
+func (dbs *databaseStorage) AddBatchItems(ctx context.Context, ids []string, values []string, expiresAt []time.Time, userID int64) ([]BatchItemResult, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Add batch items to database.\n")
+	if len(ids) != len(values) || len(ids) != len(expiresAt) {
+		err := errors.New("number of id and values is not equal")
+		log.Printf("Error adding batch items. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	// Query returns inserted short URL, or short URL which was stored before for the same original URL.
+	// Update of conflicting row doesn't change it, but makes row returned even if it was inserted
+	// by concurrent transaction after start of query. xmax is zero only for inserted rows
+	queryInsertOrGet := "INSERT INTO convertions (short_url, orig_url, deleted, expires_at) VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (orig_url) DO UPDATE SET orig_url = EXCLUDED.orig_url " +
+		"RETURNING short_url, xmax = 0"
+
+	results := make([]BatchItemResult, len(ids))
+	err := dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for i := 0; i < len(ids); i++ {
+			batch.Queue(queryInsertOrGet, values[i], ids[i], false, nullableTime(expiresAt[i]))
+		}
+		batchRes := tx.SendBatch(ctx, batch)
+		for i := 0; i < len(ids); i++ {
+			if err := batchRes.QueryRow().Scan(&results[i].Item, &results[i].Created); err != nil {
+				batchRes.Close()
+				return convertInsertError(err)
+			}
+		}
+		if err := batchRes.Close(); err != nil {
+			return err
+		}
 
-	return nil
+		historyBatch := &pgx.Batch{}
+		for i := 0; i < len(ids); i++ {
+			if results[i].Created {
+				historyBatch.Queue("INSERT INTO user_urls (user_id, short_url) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+					userID, results[i].Item)
+			}
+		}
+		if historyBatch.Len() == 0 {
+			return nil
+		}
+		historyRes := tx.SendBatch(ctx, historyBatch)
+		for i := 0; i < historyBatch.Len(); i++ {
+			if _, err := historyRes.Exec(); err != nil {
+				historyRes.Close()
+				log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+				return err
+			}
+		}
+		return historyRes.Close()
+	})
+	if err != nil {
+		log.Printf("Error adding batch items. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	return results, nil
 }
 
-func (dbs *databaseStorage) MarkDeleteBatchItems(ids []string) error {
+func (dbs *databaseStorage) MarkDeleteBatchItems(ctx context.Context, ids []string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
 	batch := &pgx.Batch{}
 	log.Printf("Mark delete batch items in database: %s.\n", ids)
 	for i := 0; i < len(ids); i++ {
 		batch.Queue("UPDATE convertions SET deleted = $1 WHERE short_url = $2", true, ids[i])
 	}
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-
 	batchRes := dbs.pool.SendBatch(ctx, batch)
-	defer batchRes.Close()
-	return nil
+	var execErr error
+	for i := 0; i < batch.Len(); i++ {
+		if _, err := batchRes.Exec(); err != nil && execErr == nil {
+			log.Printf("Exec update query error. Error message:%s\n", err.Error())
+			execErr = err
+		}
+	}
+	closeErr := batchRes.Close()
+	if execErr != nil && closeErr != nil {
+		return fmt.Errorf("%w (closing batch: %s)", execErr, closeErr.Error())
+	}
+	if execErr != nil {
+		return execErr
+	}
+	return closeErr
 }
 
-func (dbs *databaseStorage) addItemUserHistory(id string, value string, userID int) error {
-	log.Printf("Add item to user history. Short URL:%s|Original URL:%s|User ID:%d\n", value, id, userID)
-
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
+// MarkDeleteExpiredItems marks as deleted all items expired before now and returns number of marked items
+func (dbs *databaseStorage) MarkDeleteExpiredItems(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
 	defer cancelFunc()
-
-	history, err := dbs.GetUserHistory(userID)
-	if err != nil && !errors.Is(err, ErrEmptyResult) {
-		return err
+	tag, err := dbs.pool.Exec(ctx,
+		"UPDATE convertions SET deleted = $1 WHERE expires_at <= $2 AND deleted IS NOT TRUE", true, now)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+		return 0, err
 	}
-	if len(history) > 0 {
-		found := false
-		for _, historyElem := range history {
-			if historyElem.ShortURL == value && historyElem.OrigURL == id {
-				found = true
-				break
-			}
-		}
-		if found {
-			return nil
-		}
-		history = append(history, URLConversion{value, id})
-		if _, err := dbs.pool.Exec(ctx,
-			"UPDATE histories SET history = $1 WHERE user_id = $2", history, userID); err != nil {
-			log.Printf("Exec update query error. Error message:%s\n", err.Error())
-			return err
-		}
+	if tag.RowsAffected() > 0 {
+		log.Printf("Mark delete expired items in database. Number of items:%d\n", tag.RowsAffected())
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// nullableTime converts zero time to NULL for database queries
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
 		return nil
 	}
-	history = append(history, URLConversion{value, id})
-	if _, err := dbs.pool.Exec(ctx,
-		"INSERT INTO histories (user_id, history) VALUES ($1, $2)", userID, history); err != nil {
+	return t
+}
+
+// addItemUserHistory links short URL to user
+func addItemUserHistory(ctx context.Context, tx pgx.Tx, value string, userID int64) error {
+	log.Printf("Add item to user history. Short URL:%s|User ID:%d\n", value, userID)
+	if _, err := tx.Exec(ctx,
+		"INSERT INTO user_urls (user_id, short_url) VALUES ($1, $2) ON CONFLICT DO NOTHING", userID, value); err != nil {
 		log.Printf("Exec insert query error. Error message:%s\n", err.Error())
 		return err
 	}
 	return nil
 }
 
-func (dbs *databaseStorage) GetItem(value string) (*ItemResult, error) {
+func (dbs *databaseStorage) GetItem(ctx context.Context, value string) (*ItemResult, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
 	var origURL string
 	var deleted bool
+	var expiresAt *time.Time
 	log.Printf("Get original URL by short URL. Short URL:%s\n", value)
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-
-	err := dbs.pool.QueryRow(ctx, "SELECT orig_url, deleted FROM convertions WHERE short_url = $1", value).Scan(&origURL, &deleted)
+	err := dbs.pool.QueryRow(ctx, "SELECT orig_url, deleted, expires_at FROM convertions WHERE short_url = $1", value).
+		Scan(&origURL, &deleted, &expiresAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			log.Printf("Exec select query error. Error message:%s\n", err.Error())
@@ -385,18 +614,19 @@ func (dbs *databaseStorage) GetItem(value string) (*ItemResult, error) {
 		log.Printf("Exec select query error. Error message:%s\n", err.Error())
 		return nil, err
 	}
-	return &ItemResult{origURL, deleted}, nil
+	return &ItemResult{origURL, deleted, timeOrZero(expiresAt)}, nil
 }
 
-func (dbs *databaseStorage) GetItemByID(ID string) (*ItemResult, error) {
+func (dbs *databaseStorage) GetItemByID(ctx context.Context, ID string) (*ItemResult, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
 	var shortURL string
 	var deleted bool
+	var expiresAt *time.Time
 	log.Printf("Get short URL by original URL. Original URL:%s\n", ID)
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancelFunc()
-
-	err := dbs.pool.QueryRow(ctx, "SELECT short_url, deleted FROM convertions WHERE orig_url = $1", ID).Scan(&shortURL, &deleted)
+	err := dbs.pool.QueryRow(ctx, "SELECT short_url, deleted, expires_at FROM convertions WHERE orig_url = $1", ID).
+		Scan(&shortURL, &deleted, &expiresAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			log.Printf("Exec select query error. Error message:%s\n", err.Error())
@@ -405,59 +635,44 @@ func (dbs *databaseStorage) GetItemByID(ID string) (*ItemResult, error) {
 		log.Printf("Exec select query error. Error message:%s\n", err.Error())
 		return nil, err
 	}
-	return &ItemResult{shortURL, deleted}, nil
+	return &ItemResult{shortURL, deleted, timeOrZero(expiresAt)}, nil
 }
 
-func (dbs *databaseStorage) GetUserHistory(userID int) (History, error) {
-	var history History
-	log.Printf("Get user history. User ID:%d\n", userID)
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*2)
+func (dbs *databaseStorage) GetUserHistory(ctx context.Context, userID int64) (History, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
 	defer cancelFunc()
+	history := make(History, 0)
+	log.Printf("Get user history. User ID:%d\n", userID)
 
-	err := dbs.pool.QueryRow(ctx, "SELECT history FROM histories WHERE user_id = $1", userID).Scan(&history)
+	rows, err := dbs.pool.Query(ctx,
+		"SELECT c.short_url, c.orig_url FROM user_urls u JOIN convertions c ON c.short_url = u.short_url "+
+			"WHERE u.user_id = $1 ORDER BY u.added_at", userID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			log.Printf("Exec select query error. Error message:%s\n", err.Error())
-			return make(History, 0), ErrEmptyResult
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return history, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var conv URLConversion
+		if err := rows.Scan(&conv.ShortURL, &conv.OrigURL); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return make(History, 0), err
 		}
+		history = append(history, conv)
+	}
+	if err := rows.Err(); err != nil {
 		log.Printf("Exec select query error. Error message:%s\n", err.Error())
 		return make(History, 0), err
 	}
-	return history, nil
-}
-
-func (history History) Value() (driver.Value, error) {
 	if len(history) == 0 {
-		return "", nil
-	}
-	pairs := make([]string, len(history))
-	for i := 0; i < len(history); i++ {
-		pairs[i] = fmt.Sprintf("%s %s", history[i].ShortURL, history[i].OrigURL)
+		return history, ErrEmptyResult
 	}
-	return strings.Join(pairs, "|"), nil
-}
-
-func (history *History) Scan(value interface{}) error {
-	if value == nil {
-		*history = History{}
-		return nil
-	}
-	sv, err := driver.String.ConvertValue(value)
-	if err != nil {
-		log.Printf("Cannot scan value. Error message:%s\n", err.Error())
-		return fmt.Errorf("cannot scan value. %w", err)
-	}
-	v, ok := sv.(string)
-	if !ok {
-		err := errors.New("cannot scan value. cannot convert value to string")
-		log.Printf("Cannot scan value. Cannot convert value to string. Error message:%s\n", err.Error())
-		return err
-	}
-	textPairs := strings.Split(v, "|")
-	for _, textPair := range textPairs {
-		convertion := strings.Split(textPair, " ")
-		*history = append(*history, URLConversion{convertion[0], convertion[1]})
-	}
-	return nil
+	return history, nil
 }
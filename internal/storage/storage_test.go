@@ -0,0 +1,464 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/ffrxp/go-practicum/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Storage logs every operation, which makes output of stress tests unreadable
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestDataStorageConcurrentAccess(t *testing.T) {
+	const workers = 8
+	const itemsPerWorker = 50
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "in memory", source: ""},
+		{name: "file", source: filepath.Join(t.TempDir(), "storage.json")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := storage.NewDataStorage(tt.source)
+			defer ds.Close()
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					var shortURLs []string
+					for i := 0; i < itemsPerWorker; i++ {
+						origURL := fmt.Sprintf("https://example.com/%d/%d", w, i)
+						shortURL := fmt.Sprintf("%d-%d", w, i)
+						assert.NoError(t, ds.AddItem(ctx, origURL, shortURL, time.Time{}, int64(w)))
+
+						itemRes, err := ds.GetItem(ctx, shortURL)
+						if assert.NoError(t, err) {
+							assert.Equal(t, origURL, itemRes.Item)
+						}
+						_, err = ds.GetUserHistory(ctx, int64(w))
+						assert.NoError(t, err)
+						shortURLs = append(shortURLs, shortURL)
+						if i%10 == 9 {
+							assert.NoError(t, ds.MarkDeleteBatchItems(ctx, shortURLs))
+							shortURLs = nil
+						}
+					}
+				}(w)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < itemsPerWorker; i++ {
+					_, err := ds.MarkDeleteExpiredItems(ctx, time.Now())
+					assert.NoError(t, err)
+				}
+			}()
+			wg.Wait()
+
+			for w := 0; w < workers; w++ {
+				history, err := ds.GetUserHistory(ctx, int64(w))
+				require.NoError(t, err)
+				assert.Len(t, history, itemsPerWorker)
+				for i := 0; i < itemsPerWorker; i++ {
+					itemRes, err := ds.GetItem(ctx, fmt.Sprintf("%d-%d", w, i))
+					require.NoError(t, err)
+					assert.True(t, itemRes.HaveDeletedFlag)
+				}
+			}
+		})
+	}
+}
+
+func TestDataStorageConcurrentConflicts(t *testing.T) {
+	const workers = 16
+
+	ds := storage.NewDataStorage("")
+	defer ds.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	results := make(chan storage.BatchItemResult, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			res, err := ds.AddBatchItems(ctx, []string{"https://example.com"}, []string{fmt.Sprintf("code%d", w)},
+				make([]time.Time, 1), int64(w))
+			if assert.NoError(t, err) && assert.Len(t, res, 1) {
+				results <- res[0]
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(results)
+
+	created := 0
+	var createdItem string
+	var existingItems []string
+	for res := range results {
+		if res.Created {
+			created++
+			createdItem = res.Item
+			continue
+		}
+		existingItems = append(existingItems, res.Item)
+	}
+	assert.Equal(t, 1, created)
+	for _, item := range existingItems {
+		assert.Equal(t, createdItem, item)
+	}
+}
+
+func TestDataStorageBatchResults(t *testing.T) {
+	ds := storage.NewDataStorage("")
+	defer ds.Close()
+	ctx := context.Background()
+
+	require.NoError(t, ds.AddItem(ctx, "https://first.example", "first", time.Time{}, 1))
+	res, err := ds.AddBatchItems(ctx,
+		[]string{"https://first.example", "https://second.example", "https://second.example"},
+		[]string{"other", "second", "second-dup"}, make([]time.Time, 3), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.BatchItemResult{{"first", false}, {"second", true}, {"second", false}}, res)
+	history, err := ds.GetUserHistory(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// Collision rolls back whole batch
+	_, err = ds.AddBatchItems(ctx, []string{"https://third.example", "https://fourth.example"},
+		[]string{"third", "first"}, make([]time.Time, 2), 2)
+	assert.ErrorIs(t, err, storage.ErrShortURLCollision)
+	_, err = ds.GetItem(ctx, "third")
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+}
+
+func TestDataStorageJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	ds := storage.NewDataStorage(path)
+	expiresAt := time.Now().Add(time.Hour).Round(time.Second)
+	require.NoError(t, ds.AddItem(ctx, "https://first.example", "first", expiresAt, 1))
+	_, err := ds.AddBatchItems(ctx, []string{"https://second.example", "https://third.example"},
+		[]string{"second", "third"}, make([]time.Time, 2), 2)
+	require.NoError(t, err)
+	require.NoError(t, ds.MarkDeleteBatchItems(ctx, []string{"second"}))
+	require.NoError(t, ds.Close())
+
+	// Simulate crash during write of the last record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0777)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"add","short_url":"broken"`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	ds = storage.NewDataStorage(path)
+	itemRes, err := ds.GetItem(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "https://first.example", itemRes.Item)
+	assert.True(t, expiresAt.Equal(itemRes.ExpiresAt))
+	itemRes, err = ds.GetItem(ctx, "second")
+	require.NoError(t, err)
+	assert.True(t, itemRes.HaveDeletedFlag)
+	history, err := ds.GetUserHistory(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+	_, err = ds.GetItem(ctx, "broken")
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+
+	require.NoError(t, ds.AddClicks(ctx, []storage.ClickEvent{{ShortURL: "first", Time: expiresAt, Country: "DE"},
+		{ShortURL: "first", Time: expiresAt.Add(time.Minute)}}))
+	require.NoError(t, ds.AddAPIKey(ctx, storage.APIKey{ID: "active", KeyHash: "hash1", UserID: 1, CreatedAt: expiresAt}))
+	require.NoError(t, ds.AddAPIKey(ctx, storage.APIKey{ID: "revoked", KeyHash: "hash2", UserID: 2, CreatedAt: expiresAt}))
+	require.NoError(t, ds.RevokeAPIKey(ctx, "revoked", expiresAt))
+	assert.ErrorIs(t, ds.RevokeAPIKey(ctx, "unknown", expiresAt), storage.ErrEmptyResult)
+	userID, err := ds.CreateUser(ctx, expiresAt)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), userID, "IDs of users from histories must not be reused")
+	require.NoError(t, ds.TouchUser(ctx, userID, expiresAt.Add(time.Minute)))
+	assert.ErrorIs(t, ds.TouchUser(ctx, userID+1, expiresAt), storage.ErrEmptyResult)
+	require.NoError(t, ds.SetUserCredentials(ctx, userID, "alice", "hash"))
+	assert.ErrorIs(t, ds.SetUserCredentials(ctx, userID, "bob", "hash"), storage.ErrEmptyResult,
+		"login of account must not be replaced")
+	require.NoError(t, ds.MergeUserHistory(ctx, 1, userID))
+
+	// Repeated deletes are compacted into single record
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, ds.MarkDeleteBatchItems(ctx, []string{"third"}))
+	}
+	require.NoError(t, ds.Close())
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Less(t, len(content), 2000)
+	assert.Contains(t, string(content), `"country":"DE"`, "click events must be kept after compaction")
+
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	itemRes, err = ds.GetItem(ctx, "third")
+	require.NoError(t, err)
+	assert.True(t, itemRes.HaveDeletedFlag)
+	stats, err := ds.GetClickStats(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Total)
+	user, err := ds.GetUser(ctx, userID)
+	require.NoError(t, err)
+	assert.True(t, expiresAt.Add(time.Minute).Equal(user.LastSeenAt))
+	user, err = ds.GetUserByLogin(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, userID, user.ID)
+	history, err = ds.GetUserHistory(ctx, userID)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+	_, err = ds.GetUserHistory(ctx, 1)
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+	userID, err = ds.CreateUser(ctx, expiresAt)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), userID)
+	key, err := ds.GetAPIKeyByHash(ctx, "hash1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), key.UserID)
+	assert.True(t, key.RevokedAt.IsZero())
+	key, err = ds.GetAPIKeyByHash(ctx, "hash2")
+	require.NoError(t, err)
+	assert.True(t, expiresAt.Equal(key.RevokedAt))
+}
+
+func TestDataStorageTransfer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	ds := storage.NewDataStorage(path)
+	_, err := ds.AddBatchItems(ctx, []string{"https://first.example", "https://second.example"},
+		[]string{"first", "second"}, make([]time.Time, 2), 1)
+	require.NoError(t, err)
+	assert.ErrorIs(t, ds.TransferItems(ctx, []string{"first", "missing"}, 1, 2), storage.ErrEmptyResult)
+	require.NoError(t, ds.TransferItems(ctx, []string{"first"}, 1, 2))
+	require.NoError(t, ds.Close())
+
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	history, err := ds.GetUserHistory(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, storage.History{{ShortURL: "second", OrigURL: "https://second.example"}}, history)
+	history, err = ds.GetUserHistory(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, storage.History{{ShortURL: "first", OrigURL: "https://first.example"}}, history)
+}
+
+func TestDataStorageRollUpClicks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	day := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	ds := storage.NewDataStorage(path)
+	require.NoError(t, ds.AddItem(ctx, "https://first.example", "first", time.Time{}, 1))
+	require.NoError(t, ds.AddClicks(ctx, []storage.ClickEvent{{ShortURL: "first", Time: day},
+		{ShortURL: "first", Time: day.Add(time.Hour)}, {ShortURL: "first", Time: day.Add(24 * time.Hour)}}))
+	require.NoError(t, ds.RollUpClicks(ctx, day.Add(30*time.Minute)))
+	require.NoError(t, ds.AddClicks(ctx, []storage.ClickEvent{{ShortURL: "first", Time: day.Add(2 * time.Hour)}}))
+	want := &storage.ClickStats{Total: 4, Daily: []storage.DailyClicks{{Date: "2030-01-01", Clicks: 3}, {Date: "2030-01-02", Clicks: 1}}}
+	stats, err := ds.GetClickStats(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, want, stats)
+	require.NoError(t, ds.Close())
+
+	// Roll up is replayed from journal
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	stats, err = ds.GetClickStats(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, want, stats)
+}
+
+func TestDataStorageModeration(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ds := storage.NewDataStorage(path)
+	_, err := ds.AddBatchItems(ctx, []string{"https://Spam.example/a", "https://good.example", "https://spam.example/b"},
+		[]string{"s1", "good", "s2"}, []time.Time{{}, {}, expiresAt}, 1)
+	require.NoError(t, err)
+	require.NoError(t, ds.MarkDeleteBatchItems(ctx, []string{"s1", "s2"}))
+	require.NoError(t, ds.RestoreBatchItems(ctx, []string{"s2", "missing"}))
+	require.NoError(t, ds.Close())
+
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	links, err := ds.SearchItems(ctx, "SPAM", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{ShortURL: "s1", OrigURL: "https://Spam.example/a", Deleted: true},
+		{ShortURL: "s2", OrigURL: "https://spam.example/b", ExpiresAt: &expiresAt},
+	}, links)
+	links, err = ds.SearchItems(ctx, "s", 1)
+	require.NoError(t, err)
+	assert.Len(t, links, 1)
+	links, err = ds.GetUserLinks(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{
+		{ShortURL: "s1", OrigURL: "https://Spam.example/a", Deleted: true},
+		{ShortURL: "good", OrigURL: "https://good.example"},
+		{ShortURL: "s2", OrigURL: "https://spam.example/b", ExpiresAt: &expiresAt},
+	}, links)
+	_, err = ds.GetUserLinks(ctx, 2)
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+	_, err = ds.GetItem(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+}
+
+func TestDataStorageWorkspaces(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	ds := storage.NewDataStorage(path)
+	require.NoError(t, ds.AddItem(ctx, "https://first.example", "first", time.Time{}, 1))
+	workspace, err := ds.CreateWorkspace(ctx, "team", 1, "owner", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, ds.SetWorkspaceMember(ctx, workspace.ID, 2, "editor", "owner"))
+	require.NoError(t, ds.SetWorkspaceMember(ctx, workspace.ID, 3, "viewer", "owner"))
+	require.NoError(t, ds.RemoveWorkspaceMember(ctx, workspace.ID, 3, "owner"))
+	assert.ErrorIs(t, ds.SetWorkspaceMember(ctx, workspace.ID, 1, "editor", "owner"), storage.ErrLastWorkspaceOwner)
+	assert.ErrorIs(t, ds.RemoveWorkspaceMember(ctx, workspace.ID, 1, "owner"), storage.ErrLastWorkspaceOwner)
+	assert.ErrorIs(t, ds.AddWorkspaceItems(ctx, workspace.ID, []string{"missing"}), storage.ErrEmptyResult)
+	require.NoError(t, ds.AddWorkspaceItems(ctx, workspace.ID, []string{"first"}))
+	role, err := ds.GetWorkspaceRole(ctx, workspace.ID, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "editor", role)
+	_, err = ds.GetWorkspaceRole(ctx, workspace.ID, 3)
+	assert.ErrorIs(t, err, storage.ErrEmptyResult)
+	roles, err := ds.GetWorkspaceItemRoles(ctx, "first", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"editor"}, roles)
+	roles, err = ds.GetWorkspaceItemRoles(ctx, "first", 3)
+	require.NoError(t, err)
+	assert.Empty(t, roles)
+	require.NoError(t, ds.Close())
+
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	members, err := ds.GetWorkspaceMembers(ctx, workspace.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.WorkspaceMember{{UserID: 1, Role: "owner"}, {UserID: 2, Role: "editor"}}, members)
+	memberships, err := ds.GetUserWorkspaces(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	assert.Equal(t, "team", memberships[0].Name)
+	history, err := ds.GetWorkspaceHistory(ctx, workspace.ID)
+	require.NoError(t, err)
+	assert.Equal(t, storage.History{{ShortURL: "first", OrigURL: "https://first.example"}}, history)
+	next, err := ds.CreateWorkspace(ctx, "next", 1, "owner", time.Now())
+	require.NoError(t, err)
+	assert.Greater(t, next.ID, workspace.ID)
+}
+
+func TestDataStorageBrokenJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	journal := `{"op":"add","short_url":"broken
+{"op":"add","short_url":"first","original_url":"https://first.example"}
+not a record
+{"op":"add","short_url":"second","original_url":"https://second.example"}
+{"op":"history","short_url":"sec`
+	require.NoError(t, os.WriteFile(path, []byte(journal), 0777))
+
+	// Broken lines are skipped, broken end is cut off, so new records are readable after restart
+	ds, err := storage.OpenDataStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, ds.AddItem(ctx, "https://third.example", "third", time.Time{}, 1))
+	require.NoError(t, ds.Close())
+	ds, err = storage.OpenDataStorage(path)
+	require.NoError(t, err)
+	defer ds.Close()
+	for _, shortURL := range []string{"first", "second", "third"} {
+		_, err := ds.GetItem(ctx, shortURL)
+		assert.NoError(t, err, shortURL)
+	}
+	history, err := ds.GetUserHistory(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestDataStorageBrokenLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	legacy := "{\"yandex.com\":\"1389853602\"}\nbroken\n"
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0777))
+
+	_, err := storage.OpenDataStorage(path)
+	assert.ErrorIs(t, err, storage.ErrBrokenStorageFile)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, legacy, string(content))
+}
+
+func TestDataStorageLegacyFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	legacy := `{"yandex.com":"1389853602"}
+{"1389853602":true}
+{"7":[{"short_url":"1389853602","original_url":"yandex.com"}]}
+`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0777))
+
+	ds := storage.NewDataStorage(path)
+	require.NoError(t, ds.AddItem(ctx, "ya.ru", "3201241320", time.Time{}, 7))
+	require.NoError(t, ds.Close())
+
+	ds = storage.NewDataStorage(path)
+	defer ds.Close()
+	itemRes, err := ds.GetItemByID(ctx, "yandex.com")
+	require.NoError(t, err)
+	assert.Equal(t, "1389853602", itemRes.Item)
+	assert.True(t, itemRes.HaveDeletedFlag)
+	itemRes, err = ds.GetItem(ctx, "1389853602")
+	require.NoError(t, err)
+	assert.Equal(t, "yandex.com", itemRes.Item)
+	history, err := ds.GetUserHistory(ctx, 7)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+	userID, err := ds.CreateUser(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), userID)
+}
+
+func BenchmarkDataStorageGetItem(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range []int{1000, 10000, 100000} {
+		ds := storage.NewDataStorage("")
+		ids := make([]string, size)
+		values := make([]string, size)
+		for i := 0; i < size; i++ {
+			ids[i] = fmt.Sprintf("https://example.com/%d", i)
+			values[i] = fmt.Sprintf("code%d", i)
+		}
+		_, err := ds.AddBatchItems(ctx, ids, values, make([]time.Time, size), 1)
+		require.NoError(b, err)
+
+		b.Run(fmt.Sprintf("items=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ds.GetItem(ctx, values[i%size]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		ds.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"log"
+)
+
+// TransferItems moves short URLs from history of one user to history of another. Either all short URLs
+// are moved or none of them. ErrEmptyResult is returned if some short URL is not in history of fromUserID
+func (ms *dataStorage) TransferItems(ctx context.Context, shortURLs []string, fromUserID int64, toUserID int64) error {
+	log.Printf("Transfer items. Number of items:%d|From user ID:%d|To user ID:%d\n", len(shortURLs), fromUserID, toUserID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	owned := make(map[string]bool)
+	for _, conv := range ms.userHistoryStorage[fromUserID] {
+		owned[conv.ShortURL] = true
+	}
+	for _, shortURL := range shortURLs {
+		if !owned[shortURL] {
+			log.Printf("Result: item is not in user history. Short URL:%s\n", shortURL)
+			return ErrEmptyResult
+		}
+	}
+	ms.transferItems(shortURLs, fromUserID, toUserID)
+	return ms.appendToJournal(transferRecord(shortURLs, fromUserID, toUserID))
+}
+
+// transferItems moves short URLs between histories in maps. Caller must hold write lock
+func (ms *dataStorage) transferItems(shortURLs []string, fromUserID int64, toUserID int64) {
+	moving := make(map[string]bool, len(shortURLs))
+	for _, shortURL := range shortURLs {
+		moving[shortURL] = true
+	}
+	var kept History
+	for _, conv := range ms.userHistoryStorage[fromUserID] {
+		if moving[conv.ShortURL] {
+			ms.addItemUserHistory(conv.OrigURL, conv.ShortURL, toUserID)
+			continue
+		}
+		kept = append(kept, conv)
+	}
+	if len(kept) == 0 {
+		delete(ms.userHistoryStorage, fromUserID)
+		return
+	}
+	ms.userHistoryStorage[fromUserID] = kept
+}
+
+func (dbs *databaseStorage) TransferItems(ctx context.Context, shortURLs []string, fromUserID int64, toUserID int64) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Transfer items in database. Number of items:%d|From user ID:%d|To user ID:%d\n", len(shortURLs), fromUserID, toUserID)
+	return dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx,
+			"DELETE FROM user_urls WHERE user_id = $1 AND short_url = ANY($2) RETURNING short_url, added_at",
+			fromUserID, shortURLs)
+		if err != nil {
+			log.Printf("Exec delete query error. Error message:%s\n", err.Error())
+			return err
+		}
+		moved := make([][]interface{}, 0, len(shortURLs))
+		for rows.Next() {
+			row, err := rows.Values()
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			moved = append(moved, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			log.Printf("Exec delete query error. Error message:%s\n", err.Error())
+			return err
+		}
+		if len(moved) != len(shortURLs) {
+			log.Printf("Result: some items are not in user history. User ID:%d\n", fromUserID)
+			return ErrEmptyResult
+		}
+
+		batch := &pgx.Batch{}
+		for _, row := range moved {
+			batch.Queue("INSERT INTO user_urls (user_id, short_url, added_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				toUserID, row[0], row[1])
+		}
+		br := tx.SendBatch(ctx, batch)
+		for range moved {
+			if _, err := br.Exec(); err != nil {
+				log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+				br.Close()
+				return err
+			}
+		}
+		return br.Close()
+	})
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// User is the registered user. IDs are issued by storage in ascending order and never repeat.
+// Anonymous users, who are identified only by cookie, have empty login
+type User struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+	Login        string    `json:"login,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+}
+
+func (ms *dataStorage) CreateUser(ctx context.Context, now time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user := User{ID: ms.lastUserID + 1, CreatedAt: now, LastSeenAt: now}
+	ms.setUser(user)
+	log.Printf("Create user in storage. User ID:%d\n", user.ID)
+	if err := ms.appendToJournal(userRecord(user)); err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+func (ms *dataStorage) GetUser(ctx context.Context, userID int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	user, ok := ms.users[userID]
+	if !ok {
+		return nil, ErrEmptyResult
+	}
+	result := *user
+	return &result, nil
+}
+
+func (ms *dataStorage) TouchUser(ctx context.Context, userID int64, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user, ok := ms.users[userID]
+	if !ok {
+		return ErrEmptyResult
+	}
+	user.LastSeenAt = now
+	return ms.appendToJournal(userRecord(*user))
+}
+
+func (ms *dataStorage) GetUserByLogin(ctx context.Context, login string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	userID, ok := ms.userLogins[login]
+	if !ok {
+		return nil, ErrEmptyResult
+	}
+	result := *ms.users[userID]
+	return &result, nil
+}
+
+// SetUserCredentials turns user into account with login and password. ErrAlreadyExist is returned if login is taken,
+// ErrEmptyResult is returned if user doesn't exist or already has login
+func (ms *dataStorage) SetUserCredentials(ctx context.Context, userID int64, login string, passwordHash string) error {
+	log.Printf("Set user credentials. User ID:%d|Login:%s\n", userID, login)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user, ok := ms.users[userID]
+	if !ok || user.Login != "" {
+		return ErrEmptyResult
+	}
+	if _, ok := ms.userLogins[login]; ok {
+		log.Println("Result: conflict. Login already exist")
+		return ErrAlreadyExist
+	}
+	updated := *user
+	updated.Login = login
+	updated.PasswordHash = passwordHash
+	ms.setUser(updated)
+	return ms.appendToJournal(userRecord(updated))
+}
+
+// MergeUserHistory moves all items of history of one user to history of another
+func (ms *dataStorage) MergeUserHistory(ctx context.Context, fromUserID int64, toUserID int64) error {
+	log.Printf("Merge user history. From user ID:%d|To user ID:%d\n", fromUserID, toUserID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.userHistoryStorage[fromUserID]; !ok {
+		return nil
+	}
+	ms.mergeUserHistory(fromUserID, toUserID)
+	return ms.appendToJournal(mergeHistoryRecord(fromUserID, toUserID))
+}
+
+// mergeUserHistory moves history between users in maps. Caller must hold write lock
+func (ms *dataStorage) mergeUserHistory(fromUserID int64, toUserID int64) {
+	for _, conv := range ms.userHistoryStorage[fromUserID] {
+		ms.addItemUserHistory(conv.OrigURL, conv.ShortURL, toUserID)
+	}
+	delete(ms.userHistoryStorage, fromUserID)
+}
+
+// setUser adds user or replaces state of existing one. Caller must hold write lock
+func (ms *dataStorage) setUser(user User) {
+	if previous, ok := ms.users[user.ID]; ok && previous.Login != "" && previous.Login != user.Login {
+		delete(ms.userLogins, previous.Login)
+	}
+	stored := user
+	ms.users[user.ID] = &stored
+	if user.Login != "" {
+		ms.userLogins[user.Login] = user.ID
+	}
+	ms.noteUserID(user.ID)
+}
+
+// noteUserID makes sure that IDs of new users are greater than userID. Users created before registry
+// have random IDs in histories, so they are also noted. Caller must hold write lock
+func (ms *dataStorage) noteUserID(userID int64) {
+	if userID > ms.lastUserID {
+		ms.lastUserID = userID
+	}
+}
+
+func (dbs *databaseStorage) CreateUser(ctx context.Context, now time.Time) (int64, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	var userID int64
+	err := dbs.pool.QueryRow(ctx,
+		"INSERT INTO users (created_at, last_seen_at) VALUES ($1, $1) RETURNING id", now).Scan(&userID)
+	if err != nil {
+		log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+		return 0, err
+	}
+	log.Printf("Create user in database. User ID:%d\n", userID)
+	return userID, nil
+}
+
+func (dbs *databaseStorage) GetUser(ctx context.Context, userID int64) (*User, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	return dbs.queryUser(ctx, "WHERE id = $1", userID)
+}
+
+func (dbs *databaseStorage) GetUserByLogin(ctx context.Context, login string) (*User, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	return dbs.queryUser(ctx, "WHERE login = $1", login)
+}
+
+func (dbs *databaseStorage) queryUser(ctx context.Context, condition string, arg interface{}) (*User, error) {
+	var user User
+	var login, passwordHash *string
+	err := dbs.pool.QueryRow(ctx,
+		"SELECT id, created_at, last_seen_at, login, password_hash FROM users "+condition, arg).
+		Scan(&user.ID, &user.CreatedAt, &user.LastSeenAt, &login, &passwordHash)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEmptyResult
+		}
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	if login != nil {
+		user.Login = *login
+	}
+	if passwordHash != nil {
+		user.PasswordHash = *passwordHash
+	}
+	return &user, nil
+}
+
+func (dbs *databaseStorage) SetUserCredentials(ctx context.Context, userID int64, login string, passwordHash string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Set user credentials in database. User ID:%d|Login:%s\n", userID, login)
+	tag, err := dbs.pool.Exec(ctx, "UPDATE users SET login = $1, password_hash = $2 WHERE id = $3 AND login IS NULL",
+		login, passwordHash, userID)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrAlreadyExist
+		}
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrEmptyResult
+	}
+	return nil
+}
+
+func (dbs *databaseStorage) MergeUserHistory(ctx context.Context, fromUserID int64, toUserID int64) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Merge user history in database. From user ID:%d|To user ID:%d\n", fromUserID, toUserID)
+	return dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO user_urls (user_id, short_url, added_at) SELECT $1, short_url, added_at FROM user_urls "+
+				"WHERE user_id = $2 ON CONFLICT DO NOTHING", toUserID, fromUserID); err != nil {
+			log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+			return err
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM user_urls WHERE user_id = $1", fromUserID); err != nil {
+			log.Printf("Exec delete query error. Error message:%s\n", err.Error())
+			return err
+		}
+		return nil
+	})
+}
+
+func (dbs *databaseStorage) TouchUser(ctx context.Context, userID int64, now time.Time) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	tag, err := dbs.pool.Exec(ctx, "UPDATE users SET last_seen_at = $1 WHERE id = $2", now, userID)
+	if err != nil {
+		log.Printf("Exec update query error. Error message:%s\n", err.Error())
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrEmptyResult
+	}
+	return nil
+}
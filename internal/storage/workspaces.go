@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"sort"
+	"time"
+)
+
+// ErrLastWorkspaceOwner is returned if the only owner of workspace would lose ownership
+var ErrLastWorkspaceOwner = errors.New("storage: workspace must have at least one owner")
+
+// Workspace is the group of users, who share short URLs. Roles of members are checked by application
+type Workspace struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceMember struct {
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+// WorkspaceMembership describes workspace of user and role of user in it
+type WorkspaceMembership struct {
+	Workspace
+	Role string `json:"role"`
+}
+
+// CreateWorkspace creates workspace, which has the only member with role ownerRole
+func (ms *dataStorage) CreateWorkspace(ctx context.Context, name string, ownerID int64, ownerRole string, now time.Time) (*Workspace, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	workspace := Workspace{ID: ms.lastWorkspaceID + 1, Name: name, CreatedAt: now}
+	log.Printf("Create workspace in storage. Workspace ID:%d|Owner ID:%d\n", workspace.ID, ownerID)
+	ms.setWorkspace(workspace)
+	ms.setWorkspaceMember(workspace.ID, ownerID, ownerRole)
+	if err := ms.appendToJournal(workspaceRecord(workspace), memberRecord(workspace.ID, ownerID, ownerRole)); err != nil {
+		return nil, err
+	}
+	return &workspace, nil
+}
+
+func (ms *dataStorage) GetWorkspace(ctx context.Context, workspaceID int64) (*Workspace, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	workspace, ok := ms.workspaces[workspaceID]
+	if !ok {
+		return nil, ErrEmptyResult
+	}
+	result := *workspace
+	return &result, nil
+}
+
+// GetUserWorkspaces returns workspaces of user sorted by ID
+func (ms *dataStorage) GetUserWorkspaces(ctx context.Context, userID int64) ([]WorkspaceMembership, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	memberships := make([]WorkspaceMembership, 0)
+	for workspaceID, members := range ms.workspaceMembers {
+		if role, ok := members[userID]; ok {
+			memberships = append(memberships, WorkspaceMembership{*ms.workspaces[workspaceID], role})
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].ID < memberships[j].ID
+	})
+	return memberships, nil
+}
+
+// GetWorkspaceMembers returns members of workspace sorted by user ID
+func (ms *dataStorage) GetWorkspaceMembers(ctx context.Context, workspaceID int64) ([]WorkspaceMember, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	members := make([]WorkspaceMember, 0, len(ms.workspaceMembers[workspaceID]))
+	for userID, role := range ms.workspaceMembers[workspaceID] {
+		members = append(members, WorkspaceMember{userID, role})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+	return members, nil
+}
+
+// GetWorkspaceRole returns role of user in workspace. ErrEmptyResult is returned if user is not member of workspace
+func (ms *dataStorage) GetWorkspaceRole(ctx context.Context, workspaceID int64, userID int64) (string, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return "", err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	role, ok := ms.workspaceMembers[workspaceID][userID]
+	if !ok {
+		return "", ErrEmptyResult
+	}
+	return role, nil
+}
+
+// SetWorkspaceMember adds user to workspace or changes role of member. ErrLastWorkspaceOwner is returned
+// if member is the only one with ownerRole and role is different
+func (ms *dataStorage) SetWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, role string, ownerRole string) error {
+	log.Printf("Set workspace member. Workspace ID:%d|User ID:%d|Role:%s\n", workspaceID, userID, role)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.workspaces[workspaceID]; !ok {
+		return ErrEmptyResult
+	}
+	if role != ownerRole && ms.isLastOwner(workspaceID, userID, ownerRole) {
+		return ErrLastWorkspaceOwner
+	}
+	ms.setWorkspaceMember(workspaceID, userID, role)
+	return ms.appendToJournal(memberRecord(workspaceID, userID, role))
+}
+
+// RemoveWorkspaceMember removes member from workspace. ErrLastWorkspaceOwner is returned if member is the only one
+// with ownerRole
+func (ms *dataStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, ownerRole string) error {
+	log.Printf("Remove workspace member. Workspace ID:%d|User ID:%d\n", workspaceID, userID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.workspaceMembers[workspaceID][userID]; !ok {
+		return ErrEmptyResult
+	}
+	if ms.isLastOwner(workspaceID, userID, ownerRole) {
+		return ErrLastWorkspaceOwner
+	}
+	ms.setWorkspaceMember(workspaceID, userID, "")
+	return ms.appendToJournal(memberRecord(workspaceID, userID, ""))
+}
+
+// AddWorkspaceItems links existing short URLs to workspace
+func (ms *dataStorage) AddWorkspaceItems(ctx context.Context, workspaceID int64, shortURLs []string) error {
+	log.Printf("Add items to workspace. Workspace ID:%d|Number of items:%d\n", workspaceID, len(shortURLs))
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.workspaces[workspaceID]; !ok {
+		return ErrEmptyResult
+	}
+	for _, shortURL := range shortURLs {
+		if _, ok := ms.findItem(shortURL); !ok {
+			return ErrEmptyResult
+		}
+	}
+	ms.addWorkspaceItems(workspaceID, shortURLs)
+	return ms.appendToJournal(workspaceItemsRecord(workspaceID, shortURLs))
+}
+
+func (ms *dataStorage) GetWorkspaceHistory(ctx context.Context, workspaceID int64) (History, error) {
+	log.Printf("Get workspace history. Workspace ID:%d\n", workspaceID)
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return make(History, 0), err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	history := make(History, 0, len(ms.workspaceURLs[workspaceID]))
+	for _, shortURL := range ms.workspaceURLs[workspaceID] {
+		if origURL, ok := ms.findItem(shortURL); ok {
+			history = append(history, URLConversion{shortURL, origURL})
+		}
+	}
+	if len(history) == 0 {
+		return history, ErrEmptyResult
+	}
+	return history, nil
+}
+
+// GetWorkspaceItemRoles returns roles of user in workspaces, which contain short URL
+func (ms *dataStorage) GetWorkspaceItemRoles(ctx context.Context, shortURL string, userID int64) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("Request canceled. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var roles []string
+	for workspaceID, members := range ms.workspaceMembers {
+		role, ok := members[userID]
+		if !ok {
+			continue
+		}
+		for _, existing := range ms.workspaceURLs[workspaceID] {
+			if existing == shortURL {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles, nil
+}
+
+// isLastOwner checks that user is the only member of workspace with ownerRole. Caller must hold lock
+func (ms *dataStorage) isLastOwner(workspaceID int64, userID int64, ownerRole string) bool {
+	if ms.workspaceMembers[workspaceID][userID] != ownerRole {
+		return false
+	}
+	for memberID, role := range ms.workspaceMembers[workspaceID] {
+		if memberID != userID && role == ownerRole {
+			return false
+		}
+	}
+	return true
+}
+
+// setWorkspace adds workspace to maps. Caller must hold write lock
+func (ms *dataStorage) setWorkspace(workspace Workspace) {
+	stored := workspace
+	ms.workspaces[workspace.ID] = &stored
+	if workspace.ID > ms.lastWorkspaceID {
+		ms.lastWorkspaceID = workspace.ID
+	}
+}
+
+// setWorkspaceMember sets role of member. Empty role removes member. Caller must hold write lock
+func (ms *dataStorage) setWorkspaceMember(workspaceID int64, userID int64, role string) {
+	if role == "" {
+		delete(ms.workspaceMembers[workspaceID], userID)
+		return
+	}
+	if _, ok := ms.workspaceMembers[workspaceID]; !ok {
+		ms.workspaceMembers[workspaceID] = make(map[int64]string)
+	}
+	ms.workspaceMembers[workspaceID][userID] = role
+}
+
+// addWorkspaceItems adds short URLs to workspace skipping ones added before. Caller must hold write lock
+func (ms *dataStorage) addWorkspaceItems(workspaceID int64, shortURLs []string) {
+	for _, shortURL := range shortURLs {
+		found := false
+		for _, existing := range ms.workspaceURLs[workspaceID] {
+			if existing == shortURL {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ms.workspaceURLs[workspaceID] = append(ms.workspaceURLs[workspaceID], shortURL)
+		}
+	}
+}
+
+func (dbs *databaseStorage) CreateWorkspace(ctx context.Context, name string, ownerID int64, ownerRole string, now time.Time) (*Workspace, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	workspace := Workspace{Name: name, CreatedAt: now}
+	err := dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "INSERT INTO workspaces (name, created_at) VALUES ($1, $2) RETURNING id",
+			name, now).Scan(&workspace.ID); err != nil {
+			log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+			return err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)",
+			workspace.ID, ownerID, ownerRole); err != nil {
+			log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Create workspace in database. Workspace ID:%d|Owner ID:%d\n", workspace.ID, ownerID)
+	return &workspace, nil
+}
+
+func (dbs *databaseStorage) GetWorkspace(ctx context.Context, workspaceID int64) (*Workspace, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	workspace := Workspace{ID: workspaceID}
+	err := dbs.pool.QueryRow(ctx, "SELECT name, created_at FROM workspaces WHERE id = $1", workspaceID).
+		Scan(&workspace.Name, &workspace.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrEmptyResult
+		}
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	return &workspace, nil
+}
+
+func (dbs *databaseStorage) GetUserWorkspaces(ctx context.Context, userID int64) ([]WorkspaceMembership, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	rows, err := dbs.pool.Query(ctx,
+		"SELECT w.id, w.name, w.created_at, m.role FROM workspace_members m "+
+			"JOIN workspaces w ON w.id = m.workspace_id WHERE m.user_id = $1 ORDER BY w.id", userID)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	memberships := make([]WorkspaceMembership, 0)
+	for rows.Next() {
+		var membership WorkspaceMembership
+		if err := rows.Scan(&membership.ID, &membership.Name, &membership.CreatedAt, &membership.Role); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+func (dbs *databaseStorage) GetWorkspaceMembers(ctx context.Context, workspaceID int64) ([]WorkspaceMember, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	rows, err := dbs.pool.Query(ctx,
+		"SELECT user_id, role FROM workspace_members WHERE workspace_id = $1 ORDER BY user_id", workspaceID)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]WorkspaceMember, 0)
+	for rows.Next() {
+		var member WorkspaceMember
+		if err := rows.Scan(&member.UserID, &member.Role); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (dbs *databaseStorage) GetWorkspaceRole(ctx context.Context, workspaceID int64, userID int64) (string, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	var role string
+	err := dbs.pool.QueryRow(ctx, "SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+		workspaceID, userID).Scan(&role)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", ErrEmptyResult
+		}
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return "", err
+	}
+	return role, nil
+}
+
+func (dbs *databaseStorage) SetWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, role string, ownerRole string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Set workspace member in database. Workspace ID:%d|User ID:%d|Role:%s\n", workspaceID, userID, role)
+	return dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		lastOwner, err := lockWorkspaceMembers(ctx, tx, workspaceID, userID, ownerRole)
+		if err != nil {
+			return err
+		}
+		if role != ownerRole && lastOwner {
+			return ErrLastWorkspaceOwner
+		}
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role", workspaceID, userID, role); err != nil {
+			log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+			return err
+		}
+		return nil
+	})
+}
+
+func (dbs *databaseStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID int64, userID int64, ownerRole string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Remove workspace member in database. Workspace ID:%d|User ID:%d\n", workspaceID, userID)
+	return dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		lastOwner, err := lockWorkspaceMembers(ctx, tx, workspaceID, userID, ownerRole)
+		if err != nil {
+			return err
+		}
+		if lastOwner {
+			return ErrLastWorkspaceOwner
+		}
+		tag, err := tx.Exec(ctx, "DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2",
+			workspaceID, userID)
+		if err != nil {
+			log.Printf("Exec delete query error. Error message:%s\n", err.Error())
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrEmptyResult
+		}
+		return nil
+	})
+}
+
+// lockWorkspaceMembers locks row of workspace, so changes of its members are serialized until end of transaction,
+// and checks that user is the only member with ownerRole
+func lockWorkspaceMembers(ctx context.Context, tx pgx.Tx, workspaceID int64, userID int64, ownerRole string) (bool, error) {
+	var id int64
+	if err := tx.QueryRow(ctx, "SELECT id FROM workspaces WHERE id = $1 FOR UPDATE", workspaceID).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, ErrEmptyResult
+		}
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return false, err
+	}
+	var owners int
+	var isOwner bool
+	err := tx.QueryRow(ctx,
+		"SELECT count(*), COALESCE(bool_or(user_id = $3), false) FROM workspace_members "+
+			"WHERE workspace_id = $1 AND role = $2", workspaceID, ownerRole, userID).Scan(&owners, &isOwner)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return false, err
+	}
+	return isOwner && owners == 1, nil
+}
+
+func (dbs *databaseStorage) AddWorkspaceItems(ctx context.Context, workspaceID int64, shortURLs []string) error {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	log.Printf("Add items to workspace in database. Workspace ID:%d|Number of items:%d\n", workspaceID, len(shortURLs))
+	return dbs.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for _, shortURL := range shortURLs {
+			batch.Queue("INSERT INTO workspace_urls (workspace_id, short_url) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+				workspaceID, shortURL)
+		}
+		br := tx.SendBatch(ctx, batch)
+		for range shortURLs {
+			if _, err := br.Exec(); err != nil {
+				log.Printf("Exec insert query error. Error message:%s\n", err.Error())
+				br.Close()
+				var pgErr *pgconn.PgError
+				if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ForeignKeyViolation {
+					return ErrEmptyResult
+				}
+				return err
+			}
+		}
+		return br.Close()
+	})
+}
+
+func (dbs *databaseStorage) GetWorkspaceItemRoles(ctx context.Context, shortURL string, userID int64) ([]string, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	rows, err := dbs.pool.Query(ctx,
+		"SELECT m.role FROM workspace_urls w JOIN workspace_members m ON m.workspace_id = w.workspace_id "+
+			"WHERE w.short_url = $1 AND m.user_id = $2", shortURL, userID)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (dbs *databaseStorage) GetWorkspaceHistory(ctx context.Context, workspaceID int64) (History, error) {
+	ctx, cancelFunc := dbs.withQueryTimeout(ctx)
+	defer cancelFunc()
+	history := make(History, 0)
+	log.Printf("Get workspace history. Workspace ID:%d\n", workspaceID)
+
+	rows, err := dbs.pool.Query(ctx,
+		"SELECT c.short_url, c.orig_url FROM workspace_urls w JOIN convertions c ON c.short_url = w.short_url "+
+			"WHERE w.workspace_id = $1 ORDER BY w.added_at", workspaceID)
+	if err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return history, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var conv URLConversion
+		if err := rows.Scan(&conv.ShortURL, &conv.OrigURL); err != nil {
+			log.Printf("Cannot scan row. Error message:%s\n", err.Error())
+			return make(History, 0), err
+		}
+		history = append(history, conv)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Exec select query error. Error message:%s\n", err.Error())
+		return make(History, 0), err
+	}
+	if len(history) == 0 {
+		return history, ErrEmptyResult
+	}
+	return history, nil
+}